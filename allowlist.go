@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// allowlistTimeout bounds each fetch of the -allowlist-url.
+const allowlistTimeout = 30 * time.Second
+
+// allowlist permits senders by remote IP address or envelope sender
+// domain, according to a list it periodically fetches from a URL.  Each
+// line of the list is an IP address, a CIDR network or a domain; blank
+// lines and lines starting with # are ignored.  If a fetch fails, the
+// last list fetched stays in effect.
+type allowlist struct {
+	url    string
+	every  time.Duration
+	client *http.Client
+
+	mu      sync.RWMutex
+	loaded  bool
+	body    []byte // the last list fetched
+	nets    []*net.IPNet
+	domains map[string]bool
+}
+
+// newAllowlist returns an allowlist fetched from url every interval.
+// It's empty, and permits nothing, until first refreshed.
+func newAllowlist(url string, every time.Duration) *allowlist {
+	return &allowlist{url: url, every: every, client: &http.Client{Timeout: allowlistTimeout}}
+}
+
+// run refreshes the list every interval until closing is closed.
+func (a *allowlist) run(closing <-chan struct{}) {
+	t := time.NewTicker(a.every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-t.C:
+			if err := a.refresh(); err != nil {
+				log.Printf("[ALLOW] Refreshing %q failed, keeping the last list: %v\n", a.url, err)
+			}
+		}
+	}
+}
+
+// refresh fetches and applies the list, logging it if it changed.
+func (a *allowlist) refresh() error {
+	resp, err := a.client.Get(a.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	a.mu.RLock()
+	unchanged := a.loaded && bytes.Equal(body, a.body)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var (
+		nets    []*net.IPNet
+		domains = make(map[string]bool)
+	)
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		entry := strings.TrimSpace(s.Text())
+		switch {
+		case entry == "", strings.HasPrefix(entry, "#"):
+		case strings.Contains(entry, "/"), net.ParseIP(entry) != nil:
+			n, err := parseCIDRs(entry)
+			if err != nil {
+				return err
+			}
+			nets = append(nets, n...)
+		default:
+			domains[strings.ToLower(entry)] = true
+		}
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.loaded, a.body, a.nets, a.domains = true, body, nets, domains
+	a.mu.Unlock()
+
+	log.Printf("[ALLOW] Loaded %d network(s) and %d domain(s) from %q\n", len(nets), len(domains), a.url)
+
+	return nil
+}
+
+// permits reports whether the list permits mail from the sender from,
+// connected from ip, and whether a list has been loaded yet.
+func (a *allowlist) permits(ip net.IP, from string) (ok, loaded bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.loaded {
+		return false, false
+	}
+
+	return containsIP(a.nets, ip) || (strings.Contains(from, "@") && a.domains[rcptDomain(from)]), true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// alpnLinger is how long a connection's negotiated protocol is kept after
+// it closes, since the server may deliver its last message afterwards.
+const alpnLinger = time.Minute
+
+// negotiatedALPN holds the protocol negotiated by each TLS connection.
+var negotiatedALPN = newConnValues()
+
+// alpnPolicy selects or refuses the protocols clients offer with ALPN
+// during the TLS handshake.
+type alpnPolicy struct {
+	selects []string        // in order of preference
+	refuses map[string]bool // offering any fails the handshake
+}
+
+// parseALPN parses the -alpn list: protocols to select, in order of
+// preference, and protocols prefixed with "!" to refuse.
+func parseALPN(spec string) *alpnPolicy {
+	p := &alpnPolicy{refuses: make(map[string]bool)}
+	for _, proto := range strings.Split(spec, ",") {
+		switch proto = strings.TrimSpace(proto); {
+		case proto == "", proto == "!":
+		case proto[0] == '!':
+			p.refuses[proto[1:]] = true
+		default:
+			p.selects = append(p.selects, proto)
+		}
+	}
+
+	return p
+}
+
+// configForClient returns a tls.Config GetConfigForClient callback that
+// logs the protocols each client offers and applies the policy to them.
+// A client offering none of the selectable protocols negotiates none,
+// rather than failing the handshake.
+func (p *alpnPolicy) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 0 {
+			return nil, nil
+		}
+
+		addr := hello.Conn.RemoteAddr()
+		log.Printf("[ALPN] %s offered %s\n", addr, strings.Join(hello.SupportedProtos, ", "))
+
+		offered := make(map[string]bool, len(hello.SupportedProtos))
+		for _, proto := range hello.SupportedProtos {
+			if p.refuses[proto] {
+				log.Printf("[ALPN] %s refused: offered %q\n", addr, proto)
+
+				return nil, fmt.Errorf("refused ALPN protocol %q", proto)
+			}
+			offered[proto] = true
+		}
+
+		for _, proto := range p.selects {
+			if !offered[proto] {
+				continue
+			}
+
+			log.Printf("[ALPN] %s selected %q\n", addr, proto)
+			if c, ok := hello.Conn.(*conn); ok {
+				negotiatedALPN.store(c, proto)
+				c.alpn = true
+			}
+
+			cfg := base.Clone()
+			cfg.NextProtos = []string{proto}
+
+			return cfg, nil
+		}
+
+		return nil, nil
+	}
+}
+
+// alpnHandler prepends an X-SMTPdump-ALPN header to each message from a
+// connection that negotiated a protocol before passing it to next.
+func alpnHandler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		next(origin, from, to, withALPN(origin, data))
+	}
+}
+
+// alpnTransform is the alpn transform, prepending the header alpnHandler
+// would to msg.
+func alpnTransform(msg *message) ([]byte, error) {
+	return withALPN(msg.origin, msg.data), nil
+}
+
+// withALPN returns data, from origin, with an X-SMTPdump-ALPN header if its
+// connection negotiated a protocol.
+func withALPN(origin net.Addr, data []byte) []byte {
+	proto, ok := negotiatedALPN.load(origin)
+	if !ok {
+		return data
+	}
+
+	return append([]byte(fmt.Sprintf("X-SMTPdump-ALPN: %s\r\n", proto)), data...)
+}
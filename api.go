@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// api serves the HTTP API over the saved messages.
+type api struct {
+	output string
+	ext    string
+	hash   hashAlgo
+	armor  bool // stored files are armored
+	pause  *pauseSwitch
+	sinks  *sinkToggles
+}
+
+// apiRoute is an API endpoint.  The routes both register the API's
+// handlers and generate its OpenAPI description.  A path may end in
+// {parameter} segments, which the route's handler parses.
+type apiRoute struct {
+	method      string
+	path        string
+	summary     string
+	status      int    // of a successful response
+	contentType string // of a successful response's body, if it has one
+	handle      http.HandlerFunc
+}
+
+// routes returns the API's endpoints.  Its description is served at
+// /openapi.json with prefix, the path the API is served under, as its
+// server URL.
+func (a *api) routes(prefix string) []apiRoute {
+	return []apiRoute{
+		{http.MethodGet, "/export.csv", "Export the headers of saved messages as CSV",
+			http.StatusOK, "text/csv", a.exportCSV},
+		{http.MethodPost, "/pause", "Pause capture, discarding messages until resumed",
+			http.StatusNoContent, "", a.setPaused(true)},
+		{http.MethodPost, "/resume", "Resume capture",
+			http.StatusNoContent, "", a.setPaused(false)},
+		{http.MethodGet, "/sinks", "List the sinks and whether each is enabled",
+			http.StatusOK, "application/json", a.listSinks},
+		{http.MethodPost, "/sinks/{name}/{action}", "Enable or disable a sink; action is enable or disable",
+			http.StatusNoContent, "", a.toggleSink},
+		{http.MethodGet, "/openapi.json", "Describe the API",
+			http.StatusOK, "application/json", a.openAPI(prefix)},
+	}
+}
+
+// handler returns the API's request multiplexer, serving the API under
+// prefix.  The caller strips prefix from request paths.
+func (a *api) handler(prefix string) http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range a.routes(prefix) {
+		path := rt.path
+		if i := strings.Index(path, "{"); i != -1 {
+			path = path[:i]
+		}
+		mux.HandleFunc(path, rt.serve)
+	}
+
+	return mux
+}
+
+// serve calls the route's handler for requests using its method.
+func (rt apiRoute) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != rt.method {
+		w.Header().Set("Allow", rt.method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	rt.handle(w, r)
+}
+
+// exportCSV handles GET /export.csv.
+func (a *api) exportCSV(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if err := exportCSV(w, a.output, a.ext, a.hash, a.armor); err != nil {
+		log.Println(err)
+	}
+}
+
+// setPaused returns the handler for POST /pause or POST /resume.
+func (a *api) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.pause.set(paused, "API request from "+r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listSinks handles GET /sinks.
+func (a *api) listSinks(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.sinks.states()); err != nil {
+		log.Println(err)
+	}
+}
+
+// toggleSink handles POST /sinks/{name}/enable and /sinks/{name}/disable.
+func (a *api) toggleSink(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sinks/"), "/")
+	if len(parts) != 2 || (parts[1] != "enable" && parts[1] != "disable") {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if !a.sinks.set(parts[0], parts[1] == "enable", "API request from "+r.RemoteAddr) {
+		http.Error(w, fmt.Sprintf("unknown sink %q", parts[0]), http.StatusNotFound)
+
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openAPI returns the handler for GET /openapi.json.
+func (a *api) openAPI(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := a.writeSpec(w, prefix); err != nil {
+			log.Println(err)
+		}
+	}
+}
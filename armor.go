@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	armorBegin = "-----BEGIN SMTP MESSAGE-----\n"
+	armorEnd   = "-----END SMTP MESSAGE-----\n"
+
+	armorLineLen = 76
+)
+
+// armorModes are the supported -armor encodings.
+var armorModes = map[string]bool{"base64": true, "pem": true}
+
+// armor encodes data for storage as text: as base64 in lines of 76
+// characters, and for "pem" between BEGIN and END SMTP MESSAGE lines.
+func armor(mode string, data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+
+	var b bytes.Buffer
+	if mode == "pem" {
+		b.WriteString(armorBegin)
+	}
+	for len(enc) > armorLineLen {
+		b.WriteString(enc[:armorLineLen] + "\n")
+		enc = enc[armorLineLen:]
+	}
+	if enc != "" {
+		b.WriteString(enc + "\n")
+	}
+	if mode == "pem" {
+		b.WriteString(armorEnd)
+	}
+
+	return b.Bytes()
+}
+
+// dearmor reverses armor for either encoding.
+func dearmor(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(armorBegin)) {
+		end := bytes.LastIndex(data, []byte(armorEnd))
+		if end == -1 {
+			return nil, errors.New("missing END SMTP MESSAGE line")
+		}
+		data = data[len(armorBegin):end]
+	}
+
+	out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(out, bytes.Join(bytes.Fields(data), nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return out[:n], nil
+}
+
+// readMessageFile returns the content of the message file name, decoding
+// it first if it was stored with -armor.
+func readMessageFile(name string, armored bool) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil || !armored {
+		return data, err
+	}
+
+	if data, err = dearmor(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/mhale/smtpd"
+)
+
+// uncaptured counts the messages discarded by -capture-if.
+var uncaptured = newCounter("smtpdump_uncaptured_messages_total", "Messages discarded for not matching -capture-if.")
+
+// headerPredicate matches messages by a header value: exactly, ignoring
+// case and surrounding space, for "Name=value", or by regular expression
+// for "Name~=regexp".
+type headerPredicate struct {
+	spec  string
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+func parseHeaderPredicate(spec string) (*headerPredicate, error) {
+	if i := strings.Index(spec, "~="); i > 0 {
+		re, err := regexp.Compile(spec[i+2:])
+		if err != nil {
+			return nil, err
+		}
+
+		return &headerPredicate{spec: spec, name: strings.TrimSpace(spec[:i]), re: re}, nil
+	}
+
+	if i := strings.IndexByte(spec, '='); i > 0 {
+		return &headerPredicate{spec: spec, name: strings.TrimSpace(spec[:i]), value: strings.TrimSpace(spec[i+1:])}, nil
+	}
+
+	return nil, fmt.Errorf("header predicate %q isn't Name=value or Name~=regexp", spec)
+}
+
+// match reports whether any value of the header in data matches.
+func (p *headerPredicate) match(data []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	for _, v := range msg.Header[textproto.CanonicalMIMEHeaderKey(p.name)] {
+		if p.re != nil && p.re.MatchString(v) || p.re == nil && strings.EqualFold(strings.TrimSpace(v), p.value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handler returns a Handler passing only matching messages to next.
+func (p *headerPredicate) handler(next smtpd.Handler, verbose bool) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		if !p.match(data) {
+			n := uncaptured.inc()
+			if verbose {
+				log.Printf("Discarded message from %q not matching %s (%d so far)\n", from, p.spec, n)
+			}
+
+			return
+		}
+
+		next(origin, from, to, data)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// helloLimit bounds the bytes buffered while capturing a ClientHello.
+const helloLimit = 64 << 10
+
+// helloLinger is how long a connection's ClientHello fingerprint is kept
+// after it closes, since the server may deliver its last message
+// afterwards.
+const helloLinger = time.Minute
+
+// clientHelloModes are the supported -capture-clienthello modes.
+var clientHelloModes = map[string]bool{"log": true, "annotate": true}
+
+// clientFingerprints holds the JA3 fingerprint of each connection's
+// ClientHello.
+var clientFingerprints = newConnValues()
+
+var errMalformedHello = errors.New("malformed ClientHello")
+
+// clientHello is the part of a TLS ClientHello that fingerprints a client.
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16 // in the order sent
+	curves     []uint16
+	points     []uint8
+	serverName string
+	protos     []string
+}
+
+// captureHello accumulates the TLS records the client sends after
+// STARTTLS until they hold its ClientHello, then logs its fingerprint.
+func (c *conn) captureHello(b []byte) {
+	c.hello = append(c.hello, b...)
+
+	// Reassemble the handshake messages from the records read so far.
+	var msg []byte
+	for rec := c.hello; len(rec) >= 5; {
+		n := int(binary.BigEndian.Uint16(rec[3:5]))
+		if rec[0] != 22 || len(rec) < 5+n {
+			break
+		}
+		msg = append(msg, rec[5:5+n]...)
+		rec = rec[5+n:]
+	}
+
+	var complete bool
+	if len(msg) >= 4 {
+		complete = len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3]))
+	}
+
+	switch {
+	case len(c.hello) > helloLimit, len(c.hello) >= 5 && c.hello[0] != 22:
+		log.Printf("[TLS] %s didn't send a ClientHello\n", c.RemoteAddr())
+	case !complete:
+		return
+	default:
+		h, err := parseClientHello(msg)
+		if err != nil {
+			log.Printf("[TLS] %s: %v\n", c.RemoteAddr(), err)
+
+			break
+		}
+
+		ja3 := h.ja3()
+		sum := md5.Sum([]byte(ja3))
+		fp := hex.EncodeToString(sum[:])
+		log.Printf("[TLS] %s ClientHello: JA3 %s %q; SNI %q; ALPN %q\n",
+			c.RemoteAddr(), fp, ja3, h.serverName, strings.Join(h.protos, ","))
+		if c.cfg.annotateHello {
+			clientFingerprints.store(c, fp+"; "+ja3)
+		}
+	}
+
+	c.hello = nil
+	c.helloDone = true
+}
+
+// parseClientHello parses the handshake message msg, a ClientHello.
+func parseClientHello(msg []byte) (*clientHello, error) {
+	if len(msg) < 4 {
+		return nil, errMalformedHello
+	}
+	if msg[0] != 1 {
+		return nil, fmt.Errorf("handshake message type %d isn't a ClientHello", msg[0])
+	}
+	r := helloReader(msg[4:])
+
+	var h clientHello
+	h.version = r.uint16()
+	r.skip(32) // random
+	r.skip(int(r.uint8()))
+	for cs := helloReader(r.next(int(r.uint16()))); len(cs) >= 2; {
+		h.ciphers = append(h.ciphers, cs.uint16())
+	}
+	r.skip(int(r.uint8())) // compression methods
+
+	exts := helloReader(r.next(int(r.uint16())))
+	for len(exts) >= 4 {
+		typ := exts.uint16()
+		data := helloReader(exts.next(int(exts.uint16())))
+		h.extensions = append(h.extensions, typ)
+
+		switch typ {
+		case 0: // server_name
+			data.skip(2)
+			if data.uint8() == 0 {
+				h.serverName = string(data.next(int(data.uint16())))
+			}
+		case 10: // supported_groups
+			for g := helloReader(data.next(int(data.uint16()))); len(g) >= 2; {
+				h.curves = append(h.curves, g.uint16())
+			}
+		case 11: // ec_point_formats
+			h.points = append(h.points, data.next(int(data.uint8()))...)
+		case 16: // application_layer_protocol_negotiation
+			for p := helloReader(data.next(int(data.uint16()))); len(p) > 0; {
+				h.protos = append(h.protos, string(p.next(int(p.uint8()))))
+			}
+		}
+	}
+
+	if len(h.ciphers) == 0 {
+		return nil, errMalformedHello
+	}
+
+	return &h, nil
+}
+
+// ja3 returns the JA3 fingerprint string of the ClientHello: its version,
+// cipher suites, extensions, curves and point formats, with GREASE values
+// left out.
+func (h *clientHello) ja3() string {
+	list := func(vals []uint16) string {
+		s := make([]string, 0, len(vals))
+		for _, v := range vals {
+			if v&0x0f0f == 0x0a0a && v>>8 == v&0xff { // GREASE
+				continue
+			}
+			s = append(s, strconv.Itoa(int(v)))
+		}
+
+		return strings.Join(s, "-")
+	}
+
+	points := make([]uint16, len(h.points))
+	for i, p := range h.points {
+		points[i] = uint16(p)
+	}
+
+	return fmt.Sprintf("%d,%s,%s,%s,%s", h.version, list(h.ciphers), list(h.extensions),
+		list(h.curves), list(points))
+}
+
+// helloReader reads big-endian fields from a ClientHello.  Reads past its
+// end return zero values.
+type helloReader []byte
+
+func (r *helloReader) next(n int) []byte {
+	if n > len(*r) {
+		n = len(*r)
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+
+	return b
+}
+
+func (r *helloReader) skip(n int) { r.next(n) }
+
+func (r *helloReader) uint8() uint8 {
+	if b := r.next(1); len(b) == 1 {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *helloReader) uint16() uint16 {
+	if b := r.next(2); len(b) == 2 {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+// clientHelloHandler prepends an X-SMTPdump-JA3 header to each message
+// from a connection whose ClientHello was fingerprinted before passing it
+// to next.
+func clientHelloHandler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		next(origin, from, to, withJA3(origin, data))
+	}
+}
+
+// clientHelloTransform is the ja3 transform, prepending the header
+// clientHelloHandler would to msg.
+func clientHelloTransform(msg *message) ([]byte, error) {
+	return withJA3(msg.origin, msg.data), nil
+}
+
+// withJA3 returns data, from origin, with an X-SMTPdump-JA3 header if its
+// connection's ClientHello was fingerprinted.
+func withJA3(origin net.Addr, data []byte) []byte {
+	fp, ok := clientFingerprints.load(origin)
+	if !ok {
+		return data
+	}
+
+	return append([]byte(fmt.Sprintf("X-SMTPdump-JA3: %s\r\n", fp)), data...)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// testClientHello returns the TLS records of a real ClientHello.
+func testClientHello(t *testing.T) []byte {
+	t.Helper()
+
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	go func() {
+		tc := tls.Client(client, &tls.Config{ServerName: "localhost", NextProtos: []string{"smtp"}})
+		_ = tc.Handshake() // fails once the server side closes
+	}()
+
+	buf := make([]byte, helloLimit)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf[:n]
+}
+
+func TestCaptureHelloRecords(t *testing.T) {
+	hello := testClientHello(t)
+	if len(hello) < 9 || hello[0] != 22 || hello[5] != 1 {
+		t.Fatalf("unexpected ClientHello %x", hello)
+	}
+	first := 5 + 4 + 10 // the record header, handshake header and a bit
+
+	// split returns hello re-framed as one record per chunk of the
+	// handshake message.
+	split := func(chunk int) []byte {
+		msg := hello[5:]
+		var recs []byte
+		for len(msg) > 0 {
+			n := chunk
+			if n > len(msg) {
+				n = len(msg)
+			}
+			recs = append(recs, 22, hello[1], hello[2], byte(n>>8), byte(n))
+			recs = append(recs, msg[:n]...)
+			msg = msg[n:]
+		}
+
+		return recs
+	}
+
+	tests := []struct {
+		name  string
+		reads [][]byte
+		done  bool
+	}{
+		{"whole", [][]byte{hello}, true},
+		{"byte at a time", byteReads(hello), true},
+		{"record header only", [][]byte{hello[:5]}, false},
+		{"partial record", [][]byte{hello[:len(hello)-1]}, false},
+		{"partial handshake message", [][]byte{split(first)[:5+first]}, false},
+		{"record per chunk", [][]byte{split(first)}, true},
+		{"small records", byteReads(split(16)), true},
+		{"not a handshake", [][]byte{{23, 3, 3, 0, 1, 0}}, true},
+		{"not a ClientHello", [][]byte{{22, 3, 1, 0, 4, 2, 0, 0, 0}}, true},
+		{"truncated ClientHello", [][]byte{{22, 3, 1, 0, 5, 1, 0, 0, 1, 3}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			side, _ := net.Pipe()
+			c := &conn{Conn: side, cfg: &connConfig{captureHello: true}}
+			for _, b := range tt.reads {
+				c.captureHello(b)
+				if c.helloDone {
+					break
+				}
+			}
+			if c.helloDone != tt.done {
+				t.Errorf("got done %t; want %t", c.helloDone, tt.done)
+			}
+		})
+	}
+}
+
+func byteReads(b []byte) [][]byte {
+	reads := make([][]byte, len(b))
+	for i := range b {
+		reads[i] = b[i : i+1]
+	}
+
+	return reads
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	hello := testClientHello(t)
+	msg := hello[5:]
+
+	h, err := parseClientHello(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.serverName != "localhost" || len(h.protos) != 1 || h.protos[0] != "smtp" {
+		t.Errorf("got SNI %q and ALPN %q", h.serverName, h.protos)
+	}
+
+	for n := 1; n < len(msg); n++ {
+		_, _ = parseClientHello(msg[:n]) // mustn't panic
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	collectorMinBackoff = time.Second
+	collectorMaxBackoff = time.Minute
+	collectorTimeout    = 30 * time.Second
+)
+
+var errCollectorFull = errors.New("collector buffer full; message dropped")
+
+// collector ships raw messages to a remote collector over TCP, optionally
+// with TLS.  Each message is framed with an RFC 5425 octet count,
+// "<length> <message>", so the collector can split messages of any
+// content.  Messages are buffered in memory, up to a limit, while the
+// collector is unreachable.
+type collector struct {
+	addr      string
+	tlsConfig *tls.Config // nil for plain TCP
+
+	queue chan []byte
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newCollector returns a collector for addr buffering up to size
+// messages.
+func newCollector(addr string, useTLS bool, size int) (*collector, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &collector{
+		addr:  addr,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+	if useTLS {
+		c.tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	return c, nil
+}
+
+// sink returns a sink that queues each message for the collector.
+func (c *collector) sink() sink {
+	return sink{
+		name: "collector",
+		deliver: func(msg *message) error {
+			select {
+			case c.queue <- msg.data:
+				return nil
+			default:
+				return errCollectorFull
+			}
+		},
+	}
+}
+
+// Close stops the collector, first sending any buffered messages if the
+// collector is reachable.
+func (c *collector) Close() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func (c *collector) run() {
+	defer c.wg.Done()
+
+	var (
+		conn    net.Conn
+		pending []byte
+		backoff = collectorMinBackoff
+	)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		if pending == nil {
+			select {
+			case pending = <-c.queue:
+			case <-c.done:
+				select {
+				case pending = <-c.queue:
+				default:
+					return
+				}
+			}
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = c.dial()
+			if err != nil {
+				log.Printf("[collector] %v; retrying in %s\n", err, backoff)
+
+				select {
+				case <-time.After(backoff):
+				case <-c.done:
+					log.Printf("[collector] Dropped %d buffered message(s)\n", len(c.queue)+1)
+					return
+				}
+				if backoff *= 2; backoff > collectorMaxBackoff {
+					backoff = collectorMaxBackoff
+				}
+
+				continue
+			}
+			backoff = collectorMinBackoff
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(collectorTimeout))
+		if _, err := fmt.Fprintf(conn, "%d %s", len(pending), pending); err != nil {
+			log.Printf("[collector] %v\n", err)
+			_ = conn.Close()
+			conn = nil
+
+			continue
+		}
+		pending = nil
+	}
+}
+
+func (c *collector) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: collectorTimeout}
+	if c.tlsConfig != nil {
+		return tls.DialWithDialer(d, "tcp", c.addr, c.tlsConfig)
+	}
+
+	return d.Dial("tcp", c.addr)
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// preludeLimit bounds how much of the plaintext conversation is kept
+// for -capture-prelude.
+const preludeLimit = 64 << 10
+
+var (
+	// rcptRejection prefixes the smtpd server's reply when the HandlerRcpt
+	// rejects a recipient.
+	rcptRejection = []byte("550 5.1.0 ")
+
+	// unknownCommand prefixes the smtpd server's reply to an unrecognized
+	// command.
+	unknownCommand = []byte("500 5.5.2 ")
+
+	// ehloLastLine is the final line of the smtpd server's EHLO reply.
+	ehloLastLine = []byte("250 ENHANCEDSTATUSCODES")
+
+	// queuedReply is the smtpd server's reply accepting a message.
+	queuedReply = []byte("250 2.0.0 Ok: queued")
+
+	// badSequence prefixes the smtpd server's reply to a command sent out
+	// of sequence, such as DATA without an accepted recipient.
+	badSequence = []byte("503 5.5.1 ")
+
+	// handshakeFailed is the smtpd server's plaintext reply when the TLS
+	// handshake following STARTTLS fails.
+	handshakeFailed = []byte("403 4.7.0 ")
+
+	mailSizeRE = regexp.MustCompile(`(?i)\sSIZE=(\d+)`)
+
+	errEarlyTalker     = errors.New("early talker")
+	errTooManyCommands = errors.New("too many commands")
+	errSessionExpired  = errors.New("session time limit exceeded")
+
+	// conns indexes open connections by remote address so the smtpd
+	// handlers, which only receive the remote address, can find the
+	// connection's state.
+	conns = struct {
+		sync.Mutex
+		m map[string]*conn
+	}{m: make(map[string]*conn)}
+)
+
+// lookupConn returns the open connection from addr, or nil.
+func lookupConn(addr net.Addr) *conn {
+	conns.Lock()
+	defer conns.Unlock()
+
+	return conns.m[addr.String()]
+}
+
+// connConfig holds the settings applied to every accepted connection.
+type connConfig struct {
+	hostname           string
+	maxCommands        int
+	dataPromptDelay    time.Duration
+	greetingDelay      time.Duration
+	rejectEarlyTalkers bool
+	preludeDir         string    // save the plaintext before STARTTLS here
+	files              fileSlots // if set, limits the files open at once
+	unknownReply       string    // replaces the reply to unrecognized commands
+	trusted            []*net.IPNet
+	etrn               string // ETRN reply format, with the domain as its argument
+	dataChecks         []dataCheck
+	logLatency         bool                // log each connection's command latencies on close
+	onClose            func(addr net.Addr) // if set, called when a connection closes
+	logMeta            bool                // log connection metadata with mail events
+	transcriptDir      string              // record each connection's conversation here
+	captureHello       bool                // log the fingerprint of each TLS ClientHello
+	annotateHello      bool                // and add it to the connection's messages
+	maxSession         time.Duration       // close connections open longer than this
+	events             *connEvents         // if set, sent each connection's open and close
+	drops              *connDrops          // if set, picks connections to drop
+}
+
+// listener wraps a net.Listener so every accepted connection passes
+// through a conn before reaching the SMTP server.
+type listener struct {
+	net.Listener
+
+	cfg *connConfig
+}
+
+// Accept returns the next connection wrapped in a conn.
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	wc := &conn{Conn: c, cfg: l.cfg, accepted: time.Now(), id: atomic.AddUint64(&lastConnID, 1)}
+	if l.cfg.preludeDir != "" {
+		wc.prelude = new(bytes.Buffer)
+	}
+	if l.cfg.transcriptDir != "" {
+		if wc.transcript, err = newTranscript(l.cfg.transcriptDir, c, wc.accepted); err != nil {
+			log.Println(err)
+		}
+	}
+	if containsIP(l.cfg.trusted, addrIP(c.RemoteAddr())) {
+		wc.trusted = true
+		log.Printf("[CONN] %s is trusted\n", c.RemoteAddr())
+	}
+	if l.cfg.drops != nil && !wc.trusted {
+		wc.drop = l.cfg.drops.pick()
+	}
+	if l.cfg.maxSession > 0 {
+		wc.watchdog = time.AfterFunc(l.cfg.maxSession, wc.expire)
+	}
+
+	conns.Lock()
+	conns.m[c.RemoteAddr().String()] = wc
+	conns.Unlock()
+
+	if l.cfg.events != nil {
+		l.cfg.events.opened(wc)
+	}
+
+	return wc, nil
+}
+
+// transaction is the state of a single mail transaction.  It's discarded
+// whenever the SMTP server discards its own transaction state.
+type transaction struct {
+	rcpts   []string
+	size    int // declared with the MAIL SIZE parameter
+	refused int // recipients the server rejected
+}
+
+// conn inspects the SMTP conversation flowing through a connection.  Once
+// STARTTLS succeeds, the conversation is inspected through the tlsConn
+// the server switches to.
+type conn struct {
+	net.Conn
+
+	cfg        *connConfig
+	id         uint64
+	accepted   time.Time
+	trusted    bool   // exempt from filtering
+	tlsVersion uint32 // negotiated; accessed atomically
+	messages   int64  // delivered, if sending events; accessed atomically
+
+	commands int
+	resets   int
+	greeted  bool
+	data     bool      // client is sending message content
+	auth     bool      // client is answering an AUTH challenge
+	tls      bool      // the client started TLS; the stream is TLS records
+	secure   *tls.Conn // the server's TLS connection, once the handshake succeeds
+	alpn     bool      // an ALPN protocol was negotiated
+	early    []byte    // sent by the client before the greeting
+	line     []byte    // partial client line carried between reads
+	err      error     // returned by the next Read
+	prelude  *bytes.Buffer
+	reply    string // replaces the server's next RCPT rejection
+	lastCmd  string // most recent command line
+
+	body     *bytes.Buffer // content of the current DATA, if checked
+	finished *transaction  // transaction whose DATA just completed
+
+	timing      string // command awaiting its reply, if timed
+	timingStart time.Time
+	latencies   map[string]*latency
+	handshake   func() // releases the -max-handshakes slot held by the TLS handshake
+	transcript  *transcript
+	hello       []byte // TLS records read while capturing the ClientHello
+	helloDone   bool
+	watchdog    *time.Timer // ends the session after -max-session
+	expired     int32       // set by the watchdog; accessed atomically
+	drop        string      // stage at which -drop-rate drops the connection
+
+	mu     sync.Mutex
+	txn    transaction
+	authed bool // the AuthHandler accepted the client's credentials
+
+	closeOnce sync.Once
+}
+
+// Read reads from the client, counting the commands it sends.  If the
+// client exceeds the command limit, Read returns only the permitted
+// commands, then replies 421 and fails the following Read so the server
+// drops the connection.  Once the client starts TLS, Read passes its
+// records through to the server's TLS connection, and the conversation is
+// inspected by the tlsConn over it instead.
+func (c *conn) Read(p []byte) (int, error) {
+	if !c.tls {
+		return c.read(c.Conn, p)
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.Conn.Read(p)
+	if c.cfg.captureHello && !c.helloDone && n > 0 {
+		c.captureHello(p[:n])
+	}
+
+	return n, err
+}
+
+// read reads the client's lines from src, the plaintext connection or the
+// TLS connection over it, inspecting them on their way to the server.
+func (c *conn) read(src net.Conn, p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+
+	if c.err == nil && atomic.LoadInt32(&c.expired) == 1 {
+		c.sessionExpired()
+	}
+
+	if c.err == nil && c.drop == "greeting" {
+		c.dropNow("after the greeting")
+	}
+
+	switch {
+	case len(c.early) > 0:
+		n = copy(p, c.early)
+		c.early = c.early[n:]
+	case c.err != nil:
+		return 0, c.err
+	default:
+		n, err = src.Read(p)
+		if c.transcript != nil && n > 0 {
+			c.transcript.record('C', p[:n])
+		}
+		if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+			c.sessionExpired()
+
+			return 0, c.err
+		}
+	}
+
+	if n == 0 {
+		return n, err
+	}
+
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			c.line = append(c.line, data...)
+			break
+		}
+		c.line = append(c.line, data[:i+1]...)
+		data = data[i+1:]
+		c.capture("C: ", c.line)
+
+		if !c.command(c.line) {
+			c.early = nil
+			c.err = errTooManyCommands
+			n -= len(data) + i + 1
+			c.tooManyCommands()
+
+			return n, nil
+		}
+		if c.drop != "" && c.dropDue() {
+			where := "mid-RCPT"
+			if c.data {
+				where = "mid-DATA"
+			}
+			n -= len(data) + i + 1
+			c.dropNow(where)
+
+			return n, nil
+		}
+		c.line = c.line[:0]
+	}
+
+	return n, err
+}
+
+// Write writes a server reply to the client, tracking the replies that
+// change how the client's subsequent lines are interpreted.  Once the
+// client starts TLS, Write passes the server's records through, unless
+// the handshake fails and the server carries on in plaintext.
+func (c *conn) Write(p []byte) (int, error) {
+	if !c.tls {
+		return c.write(c.Conn, p)
+	}
+
+	if c.secure == nil && bytes.HasPrefix(p, handshakeFailed) {
+		if c.handshake != nil {
+			c.handshake()
+		}
+		c.tls = false
+		log.Printf("[TLS] %s handshake failed; continuing in plaintext\n", c.RemoteAddr())
+		if c.transcript != nil {
+			c.transcript.note("TLS handshake failed; the session continues in plaintext")
+		}
+
+		return c.write(c.Conn, p)
+	}
+
+	return c.Conn.Write(p)
+}
+
+// write writes a server reply to dst, the plaintext connection or the TLS
+// connection over it, rewriting and tracking it on its way to the client.
+func (c *conn) write(dst net.Conn, p []byte) (int, error) {
+	if c.err == errSessionExpired {
+		return len(p), nil
+	}
+
+	if !c.greeted {
+		c.greeted = true
+
+		if c.cfg.greetingDelay > 0 && !c.trusted && !c.holdGreeting() {
+			return len(p), nil
+		}
+	}
+
+	n := len(p)
+	switch {
+	case c.reply != "" && bytes.HasPrefix(p, rcptRejection):
+		p = []byte(c.reply + "\r\n")
+	case c.finished != nil && bytes.HasPrefix(p, queuedReply):
+		if reply := c.checkData(); reply != "" {
+			p = []byte(reply + "\r\n")
+		}
+	case bytes.HasPrefix(p, badSequence) && c.verb() == "DATA" && c.noValidRcpts():
+		log.Printf("[DATA] %s refused: no valid recipients\n", c.RemoteAddr())
+		p = []byte(fmt.Sprintf("554 5.5.1 %s No valid recipients\r\n", c.cfg.hostname))
+	case bytes.HasPrefix(p, unknownCommand) && c.cfg.etrn != "" && c.verb() == "ETRN":
+		p = []byte(c.etrnReply() + "\r\n")
+	case bytes.HasPrefix(p, unknownCommand):
+		log.Printf("[CMD] %s unknown command %q\n", c.RemoteAddr(), c.lastCmd)
+		if c.cfg.unknownReply != "" {
+			p = []byte(c.cfg.unknownReply + "\r\n")
+		}
+	case c.cfg.etrn != "" && c.verb() == "EHLO" && bytes.HasPrefix(p, []byte("250-")):
+		p = bytes.Replace(p, ehloLastLine, append([]byte("250-ETRN\r\n"), ehloLastLine...), 1)
+	}
+	c.reply = ""
+	c.finished = nil
+
+	if c.verb() == "RCPT" && (p[0] == '4' || p[0] == '5') && !bytes.HasPrefix(p, badSequence) {
+		c.mu.Lock()
+		c.txn.refused++
+		c.mu.Unlock()
+	}
+
+	c.capture("S: ", p)
+
+	switch {
+	case bytes.HasPrefix(p, []byte("354 ")):
+		c.data = true
+		if len(c.cfg.dataChecks) > 0 {
+			c.body = new(bytes.Buffer)
+		}
+
+		if d := c.cfg.dataPromptDelay; d > 0 {
+			log.Printf("[DATA] %s delaying 354 prompt by %s\n", c.RemoteAddr(), d)
+			time.Sleep(d)
+		}
+	case bytes.HasPrefix(p, []byte("334 ")):
+		c.auth = true
+	case bytes.HasPrefix(p, []byte("220 2.0.0 Ready to start TLS")):
+		c.tls = true
+		c.reset()
+	}
+
+	c.observeReply()
+	if c.transcript != nil {
+		c.transcript.record('S', p)
+		if c.tls && c.secure == nil {
+			c.transcript.note("STARTTLS; the rest of the session is recorded decrypted")
+		}
+	}
+	if _, err := dst.Write(p); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// tlsConn is the TLS connection the server switches to after STARTTLS.
+// It inspects the decrypted conversation as its conn does the plaintext.
+type tlsConn struct {
+	*tls.Conn
+
+	c *conn
+}
+
+// wrapTLS is the server's TLSConnWrapper, called once the handshake
+// succeeds.  It returns the TLS connection established over nc wrapped in
+// a tlsConn, if nc is a conn.
+func wrapTLS(nc net.Conn, tc *tls.Conn) net.Conn {
+	c, ok := nc.(*conn)
+	if !ok {
+		return tc
+	}
+	c.secure = tc
+	atomic.StoreUint32(&c.tlsVersion, uint32(tc.ConnectionState().Version))
+	if c.handshake != nil {
+		c.handshake()
+	}
+
+	return &tlsConn{Conn: tc, c: c}
+}
+
+func (t *tlsConn) Read(p []byte) (int, error) {
+	return t.c.read(t.Conn, p)
+}
+
+func (t *tlsConn) Write(p []byte) (int, error) {
+	return t.c.write(t.Conn, p)
+}
+
+// checkData runs the data checks on the transaction that just completed
+// and records their verdict.  It returns the reply rejecting the message,
+// if any.
+func (c *conn) checkData() string {
+	body := c.body.Bytes()
+	c.body = nil
+
+	var v verdict
+	var reply string
+	if !c.trusted {
+		v, reply = runChecks(c.cfg.dataChecks, c, c.finished, body)
+	}
+
+	if v.rejected || len(v.headers) > 0 {
+		addVerdict(c.RemoteAddr(), body, v)
+	}
+
+	return reply
+}
+
+// verb returns the uppercased verb of the most recent command.
+func (c *conn) verb() string {
+	fields := strings.Fields(c.lastCmd)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return strings.ToUpper(fields[0])
+}
+
+// etrnReply returns the reply to the most recent command, an ETRN.
+func (c *conn) etrnReply() string {
+	fields := strings.Fields(c.lastCmd)
+	if len(fields) != 2 {
+		return "501 5.5.4 Syntax: ETRN node"
+	}
+
+	log.Printf("[ETRN] %s requested %q\n", c.RemoteAddr(), fields[1])
+
+	return fmt.Sprintf(c.cfg.etrn, fields[1])
+}
+
+// holdGreeting delays the greeting, watching for clients that talk before
+// they're greeted.  It reports whether the greeting should be sent.
+// Anything the client sends in the meantime is kept for the server.
+func (c *conn) holdGreeting() bool {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.cfg.greetingDelay))
+
+	buf := make([]byte, 512)
+	for {
+		n, err := c.Conn.Read(buf)
+		c.early = append(c.early, buf[:n]...)
+		if c.transcript != nil && n > 0 {
+			c.transcript.record('C', buf[:n])
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				c.err = err
+			}
+			break
+		}
+	}
+
+	_ = c.Conn.SetReadDeadline(time.Time{})
+
+	if len(c.early) == 0 {
+		return true
+	}
+
+	log.Printf("[CONN] %s early talker: sent %d byte(s) before the greeting\n", c.RemoteAddr(), len(c.early))
+	if !c.cfg.rejectEarlyTalkers {
+		return true
+	}
+
+	c.early = nil
+	c.err = errEarlyTalker
+	_, _ = fmt.Fprintf(c.Conn, "554 5.7.1 %s Talking before the greeting isn't permitted\r\n", c.cfg.hostname)
+
+	return false
+}
+
+// Close closes the connection and removes it from the index.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		conns.Lock()
+		if key := c.RemoteAddr().String(); conns.m[key] == c {
+			delete(conns.m, key)
+		}
+		conns.Unlock()
+
+		if c.prelude != nil && c.secure != nil {
+			c.savePrelude()
+		}
+
+		if c.cfg.logLatency {
+			c.logLatencies()
+		}
+
+		if c.alpn {
+			negotiatedALPN.release(c, alpnLinger)
+		}
+
+		if c.handshake != nil {
+			c.handshake()
+		}
+
+		if c.watchdog != nil {
+			c.watchdog.Stop()
+		}
+
+		if c.cfg.annotateHello {
+			clientFingerprints.release(c, helloLinger)
+		}
+
+		if c.transcript != nil {
+			if err := c.transcript.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if c.cfg.onClose != nil {
+			c.cfg.onClose(c.RemoteAddr())
+		}
+
+		if c.cfg.events != nil {
+			c.cfg.events.closed(c)
+		}
+	})
+
+	return c.Conn.Close()
+}
+
+// capture appends the lines in b to the prelude, each marked with prefix.
+func (c *conn) capture(prefix string, b []byte) {
+	if c.prelude == nil || c.secure != nil {
+		return
+	}
+
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 || c.prelude.Len()+len(prefix)+len(line) > preludeLimit {
+			continue
+		}
+		c.prelude.WriteString(prefix)
+		c.prelude.Write(line)
+	}
+}
+
+// savePrelude writes the plaintext conversation that preceded STARTTLS to
+// a new file in the prelude directory.
+func (c *conn) savePrelude() {
+	defer c.cfg.files.acquire()()
+
+	f, err := randFile(c.cfg.preludeDir, fmt.Sprintf("%d_prelude", c.accepted.UnixNano()), "txt")
+	if err != nil {
+		log.Println(err)
+
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = fmt.Fprintf(f, "Remote: %s\r\nAccepted: %s\r\n\r\n%s",
+		c.RemoteAddr(), c.accepted.Format(time.RFC3339Nano), c.prelude.Bytes())
+	if err != nil {
+		log.Println(err)
+
+		return
+	}
+
+	log.Printf("[CONN] %s wrote STARTTLS prelude to %q\n", c.RemoteAddr(), f.Name())
+}
+
+// rcptReply replaces the server's generic reply to a rejected recipient
+// with reply.  It must be called from the HandlerRcpt rejecting the
+// recipient.
+func (c *conn) rcptReply(reply string) {
+	c.reply = reply
+}
+
+// addRcpt records an accepted recipient in the current transaction.
+func (c *conn) addRcpt(rcpt string) {
+	c.mu.Lock()
+	c.txn.rcpts = append(c.txn.rcpts, rcpt)
+	c.mu.Unlock()
+}
+
+// setAuthenticated records that the client has authenticated.
+func (c *conn) setAuthenticated() {
+	c.mu.Lock()
+	c.authed = true
+	c.mu.Unlock()
+}
+
+// authenticated reports whether the client has authenticated.
+func (c *conn) authenticated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.authed
+}
+
+// rcptCount returns the number of recipients in the current transaction.
+func (c *conn) rcptCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.txn.rcpts)
+}
+
+// hasRcpt reports whether rcpt is already a recipient of the current
+// transaction.  Domains are compared case-insensitively.
+func (c *conn) hasRcpt(rcpt string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.txn.rcpts {
+		if sameAddr(r, rcpt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noValidRcpts reports whether the server rejected every recipient of the
+// current transaction.
+func (c *conn) noValidRcpts() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.txn.rcpts) == 0 && c.txn.refused > 0
+}
+
+// rcptDomains returns the number of distinct recipient domains in the
+// current transaction if rcpt were added to it.
+func (c *conn) rcptDomains(rcpt string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	domains := map[string]struct{}{rcptDomain(rcpt): {}}
+	for _, r := range c.txn.rcpts {
+		domains[rcptDomain(r)] = struct{}{}
+	}
+
+	return len(domains)
+}
+
+// reset discards the current transaction and returns it.
+func (c *conn) reset() transaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn := c.txn
+	c.txn = transaction{}
+
+	return txn
+}
+
+// command accounts for a complete client line and reports whether the
+// connection is still within its command limit.
+func (c *conn) command(line []byte) bool {
+	switch {
+	case c.data:
+		switch {
+		case bytes.Equal(line, []byte(".\r\n")):
+			c.data = false
+			txn := c.reset()
+			if c.body != nil {
+				c.finished = &txn
+			}
+		case c.body != nil && line[0] == '.':
+			c.body.Write(line[1:])
+		case c.body != nil:
+			c.body.Write(line)
+		}
+
+		return true
+	case c.auth:
+		c.auth = false
+
+		return true
+	}
+
+	c.commands++
+	c.lastCmd = strings.TrimSpace(string(line))
+	c.timeCommand(c.verb())
+
+	switch c.verb() {
+	case "RSET":
+		c.resets++
+		txn := c.reset()
+		log.Printf("[RSET] %s reset #%d discarded %d recipient(s)\n",
+			c.RemoteAddr(), c.resets, len(txn.rcpts))
+	case "HELO", "EHLO":
+		c.reset()
+	case "MAIL":
+		c.reset()
+		if m := mailSizeRE.FindStringSubmatch(c.lastCmd); m != nil {
+			c.mu.Lock()
+			c.txn.size, _ = strconv.Atoi(m[1])
+			c.mu.Unlock()
+		}
+	}
+
+	return c.trusted || c.cfg.maxCommands <= 0 || c.commands <= c.cfg.maxCommands
+}
+
+// expire is called by the watchdog when the session has lasted
+// -max-session.  It interrupts the server's pending Read, so the session
+// ends on the server's goroutine, in sessionExpired.
+func (c *conn) expire() {
+	atomic.StoreInt32(&c.expired, 1)
+	_ = c.Conn.SetReadDeadline(time.Now())
+}
+
+// sessionExpired fails the connection's Reads, so the server drops it,
+// and discards the server's later replies.  Unless it's interrupting a
+// TLS handshake, the client is sent a 421 first.
+func (c *conn) sessionExpired() {
+	log.Printf("[CONN] %s exceeded the %s session limit; closing\n", c.RemoteAddr(), c.cfg.maxSession)
+	if !c.tls || c.secure != nil {
+		_, _ = fmt.Fprintf(c.session(), "421 4.4.2 %s Session time limit exceeded, closing transmission channel\r\n",
+			c.cfg.hostname)
+	}
+
+	c.early = nil
+	c.err = errSessionExpired
+}
+
+func (c *conn) tooManyCommands() {
+	log.Printf("[CONN] %s exceeded %d commands; closing\n", c.RemoteAddr(), c.cfg.maxCommands)
+	_, _ = fmt.Fprintf(c.session(), "421 4.7.0 %s Too many commands, closing transmission channel\r\n", c.cfg.hostname)
+}
+
+// session returns the connection the session is conducted over: the
+// server's TLS connection, once the client has started TLS.
+func (c *conn) session() net.Conn {
+	if c.secure != nil {
+		return c.secure
+	}
+
+	return c.Conn
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// testTLSConfig returns a TLS config with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// testServer serves SMTP with TLS on a local port through a listener with
+// cfg, and returns its address.
+func testServer(t *testing.T, cfg *connConfig) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	srv := &smtpd.Server{
+		Appname:        "test",
+		Hostname:       cfg.hostname,
+		Handler:        func(net.Addr, string, []string, []byte) {},
+		TLSConfig:      testTLSConfig(t),
+		TLSConnWrapper: wrapTLS,
+	}
+	go func() { _ = srv.Serve(&listener{Listener: ln, cfg: cfg}) }()
+
+	return ln.Addr().String()
+}
+
+// testClient is a line-oriented client speaking SMTP in plaintext.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = nc.Close() })
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := &testClient{t: t, conn: nc, r: bufio.NewReader(nc)}
+	c.expect("220 ")
+
+	return c
+}
+
+// send writes line and returns the final line of the reply.
+func (c *testClient) send(line string) string {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.reply()
+}
+
+func (c *testClient) reply() string {
+	c.t.Helper()
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading reply: %v", err)
+		}
+		if len(line) < 4 || line[3] != '-' {
+			return strings.TrimSpace(line)
+		}
+	}
+}
+
+func (c *testClient) expect(prefix string) {
+	c.t.Helper()
+
+	if r := c.reply(); !strings.HasPrefix(r, prefix) {
+		c.t.Fatalf("got reply %q; want %q", r, prefix)
+	}
+}
+
+func TestFailedHandshakeKeepsInspecting(t *testing.T) {
+	addr := testServer(t, &connConfig{hostname: "test", maxCommands: 4})
+	c := dialTest(t, addr)
+
+	if r := c.send("EHLO client"); !strings.HasPrefix(r, "250 ") {
+		t.Fatalf("EHLO: %q", r)
+	}
+	if r := c.send("STARTTLS"); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("STARTTLS: %q", r)
+	}
+	if r := c.send("not a ClientHello"); !strings.HasPrefix(r, "403 ") {
+		t.Fatalf("handshake: %q", r)
+	}
+
+	// The session carries on in plaintext, still within the command limit.
+	for i := 3; i <= 4; i++ {
+		if r := c.send("NOOP"); !strings.HasPrefix(r, "250 ") {
+			t.Fatalf("command %d: %q", i, r)
+		}
+	}
+	if r := c.send("NOOP"); !strings.HasPrefix(r, "421 ") {
+		t.Fatalf("command over the limit: got %q; want 421", r)
+	}
+}
+
+func TestTLSSessionInspected(t *testing.T) {
+	addr := testServer(t, &connConfig{hostname: "test", maxCommands: 4})
+	c := dialTest(t, addr)
+
+	c.send("EHLO client")
+	if r := c.send("STARTTLS"); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("STARTTLS: %q", r)
+	}
+
+	tc := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.conn, c.r = tc, bufio.NewReader(tc)
+
+	for i := 3; i <= 4; i++ {
+		if r := c.send("NOOP"); !strings.HasPrefix(r, "250 ") {
+			t.Fatalf("command %d: %q", i, r)
+		}
+	}
+	if r := c.send("NOOP"); !strings.HasPrefix(r, "421 ") {
+		t.Fatalf("command over the limit: got %q; want 421", r)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+const (
+	connEventBuffer  = 1000
+	connEventTimeout = 10 * time.Second
+)
+
+// connEvent is the JSON body POSTed to the -conn-webhook when a
+// connection opens or closes.
+type connEvent struct {
+	Event      string  `json:"event"` // "open" or "close"
+	Time       string  `json:"time"`
+	ConnID     uint64  `json:"conn_id"`
+	RemoteIP   string  `json:"remote_ip"`
+	RemoteAddr string  `json:"remote_addr"`
+	LocalAddr  string  `json:"local_addr"`
+	TLS        bool    `json:"tls"`
+	TLSVersion string  `json:"tls_version,omitempty"`
+	Duration   float64 `json:"duration_seconds,omitempty"`
+	Messages   int64   `json:"messages"`
+	Reason     string  `json:"reason,omitempty"` // why the connection closed
+}
+
+// connEvents POSTs connection open and close events to a webhook.  At
+// most rate events are sent each second; the rest are dropped, as are
+// events that arrive while the buffer of unsent events is full.
+type connEvents struct {
+	url    string
+	rate   int
+	client *http.Client
+	queue  chan connEvent
+
+	mu      sync.Mutex
+	window  time.Time // start of the current second
+	sent    int       // events accepted in the current second
+	dropped int
+}
+
+// newConnEvents returns events posted to url and starts sending them.
+func newConnEvents(url string, rate int) *connEvents {
+	e := &connEvents{
+		url:    url,
+		rate:   rate,
+		client: &http.Client{Timeout: connEventTimeout},
+		queue:  make(chan connEvent, connEventBuffer),
+	}
+	go e.run()
+
+	return e
+}
+
+// opened sends the event for c opening.
+func (e *connEvents) opened(c *conn) {
+	e.send(c.event("open"))
+}
+
+// closed sends the event for c closing.
+func (e *connEvents) closed(c *conn) {
+	ev := c.event("close")
+	ev.Duration = time.Since(c.accepted).Seconds()
+
+	switch {
+	case c.err != nil:
+		ev.Reason = c.err.Error()
+	case c.verb() == "QUIT":
+		ev.Reason = "quit"
+	default:
+		ev.Reason = "disconnected"
+	}
+
+	e.send(ev)
+}
+
+// handler counts each message against its connection before passing it
+// to next.
+func (e *connEvents) handler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		if c := lookupConn(origin); c != nil {
+			atomic.AddInt64(&c.messages, 1)
+		}
+
+		next(origin, from, to, data)
+	}
+}
+
+// send queues ev unless it's over the rate limit or the queue is full.
+func (e *connEvents) send(ev connEvent) {
+	e.mu.Lock()
+	if now := time.Now(); now.Sub(e.window) >= time.Second {
+		if e.dropped > 0 {
+			log.Printf("[EVENT] Dropped %d connection event(s) over the rate of %d/s\n", e.dropped, e.rate)
+		}
+		e.window, e.sent, e.dropped = now, 0, 0
+	}
+	ok := e.sent < e.rate
+	if ok {
+		e.sent++
+	} else {
+		e.dropped++
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case e.queue <- ev:
+	default:
+		log.Printf("[EVENT] Dropped %s event for connection %d: queue full\n", ev.Event, ev.ConnID)
+	}
+}
+
+// run POSTs queued events in order.
+func (e *connEvents) run() {
+	for ev := range e.queue {
+		if err := e.post(ev); err != nil {
+			log.Printf("[EVENT] %s event for connection %d: %v\n", ev.Event, ev.ConnID, err)
+		}
+	}
+}
+
+func (e *connEvents) post(ev connEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	return nil
+}
+
+// event returns the event named name describing c.
+func (c *conn) event(name string) connEvent {
+	ev := connEvent{
+		Event:      name,
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		ConnID:     c.id,
+		RemoteAddr: c.RemoteAddr().String(),
+		LocalAddr:  c.LocalAddr().String(),
+		TLS:        c.tls,
+		Messages:   atomic.LoadInt64(&c.messages),
+	}
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		ev.RemoteIP = ip.String()
+	}
+	if v := atomic.LoadUint32(&c.tlsVersion); v != 0 {
+		ev.TLSVersion = tlsVersions[uint16(v)]
+	}
+
+	return ev
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lastConnID is the ID of the most recently accepted connection.
+var lastConnID uint64 // accessed atomically
+
+// tlsVersions names the TLS versions for -log-conn-meta.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// connMeta returns the metadata of the open connection from origin,
+// formatted to follow a log message, if its listener logs connection
+// metadata.  Otherwise, it returns "".
+func connMeta(origin net.Addr) string {
+	c := lookupConn(origin)
+	if c == nil || !c.cfg.logMeta {
+		return ""
+	}
+
+	version := "none"
+	if v := atomic.LoadUint32(&c.tlsVersion); v != 0 {
+		version = tlsVersions[uint16(v)]
+		if version == "" {
+			version = fmt.Sprintf("0x%04x", v)
+		}
+	}
+
+	return fmt.Sprintf(" (conn=%d local=%s remote=%s tls=%s age=%s)", c.id, c.LocalAddr(), c.RemoteAddr(),
+		version, time.Since(c.accepted).Round(time.Millisecond))
+}
+
+// connValues holds a value for each connection, keyed by remote address.
+// A value outlives its connection by a linger period, since the server
+// may deliver the connection's last message after it closes.  Each value
+// records the connection it belongs to, so a new connection from the
+// same address neither sees nor loses its predecessor's value.
+type connValues struct {
+	mu sync.Mutex
+	m  map[string]connValue
+}
+
+type connValue struct {
+	id    uint64 // of the connection the value belongs to
+	value string
+}
+
+func newConnValues() *connValues {
+	return &connValues{m: make(map[string]connValue)}
+}
+
+// store sets the value of c.
+func (v *connValues) store(c *conn, value string) {
+	v.mu.Lock()
+	v.m[c.RemoteAddr().String()] = connValue{id: c.id, value: value}
+	v.mu.Unlock()
+}
+
+// load returns the value of the open connection from addr or, if none
+// is open, of the last connection from addr that closed.
+func (v *connValues) load(addr net.Addr) (string, bool) {
+	v.mu.Lock()
+	e, ok := v.m[addr.String()]
+	v.mu.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	if c := lookupConn(addr); c != nil && c.id != e.id {
+		return "", false
+	}
+
+	return e.value, true
+}
+
+// release deletes the value of c, which has closed, after linger.  It's
+// kept if another connection from the same address has set its own.
+func (v *connValues) release(c *conn, linger time.Duration) {
+	addr, id := c.RemoteAddr().String(), c.id
+	time.AfterFunc(linger, func() {
+		v.mu.Lock()
+		if e, ok := v.m[addr]; ok && e.id == id {
+			delete(v.m, addr)
+		}
+		v.mu.Unlock()
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// defaultExecutableTypes are the -executable-types refused by
+// -reject-executables.
+const defaultExecutableTypes = ".bat,.cmd,.com,.cpl,.exe,.hta,.jar,.js,.lnk,.msi,.pif,.ps1,.scr,.vbs," +
+	"application/x-dosexec,application/x-msdos-program,application/x-msdownload,application/x-executable"
+
+var (
+	errExecutable      = errors.New("executable attachment")
+	errAttachmentLimit = errors.New("attachment limit exceeded")
+)
+
+// sizeCheck returns a dataCheck comparing a message's size to the SIZE
+// the client declared.  Sizes differing by more than tolerance, a
+// fraction of the declared size, are rejected with a 552 if reject is
+// set, or else annotated.
+func sizeCheck(hostname string, tolerance float64, reject bool) dataCheck {
+	return func(c *conn, txn *transaction, body []byte) (string, []string) {
+		if txn.size <= 0 {
+			return "", nil
+		}
+
+		actual := len(body)
+		if math.Abs(float64(actual-txn.size)) <= tolerance*float64(txn.size) {
+			return "", nil
+		}
+
+		log.Printf("[DATA] %s declared SIZE=%d but sent %d bytes\n", c.RemoteAddr(), txn.size, actual)
+		if reject {
+			return fmt.Sprintf("552 5.3.4 %s Message size %d doesn't match declared SIZE=%d",
+				hostname, actual, txn.size), nil
+		}
+
+		return "", []string{fmt.Sprintf("X-SMTPdump-Size-Mismatch: declared=%d actual=%d", txn.size, actual)}
+	}
+}
+
+// strict7bitCheck returns a dataCheck finding bytes with the high bit set
+// in a message, which a client may only send once 8BITMIME is negotiated.
+// The smtpd server never offers 8BITMIME, so any are a violation.  Such
+// messages are rejected with a 554 if reject is set, or else annotated.
+func strict7bitCheck(hostname string, reject bool) dataCheck {
+	return func(c *conn, _ *transaction, body []byte) (string, []string) {
+		i := bytes.IndexFunc(body, func(r rune) bool { return r >= 0x80 })
+		if i == -1 {
+			return "", nil
+		}
+
+		log.Printf("[DATA] %s sent 8-bit content without 8BITMIME at offset %d\n", c.RemoteAddr(), i)
+		if reject {
+			return fmt.Sprintf("554 5.6.3 %s 8-bit content requires 8BITMIME, which isn't supported", hostname), nil
+		}
+
+		return "", []string{fmt.Sprintf("X-SMTPdump-8bit: offset=%d", i)}
+	}
+}
+
+// sessionSizeCheck returns a dataCheck rejecting messages larger than
+// authMax bytes from authenticated sessions or anonMax bytes from
+// anonymous ones.  A limit of 0 is unlimited.
+func sessionSizeCheck(hostname string, authMax, anonMax int) dataCheck {
+	return func(c *conn, _ *transaction, body []byte) (string, []string) {
+		limit, session := anonMax, "anonymous"
+		if c.authenticated() {
+			limit, session = authMax, "authenticated"
+		}
+		if limit <= 0 || len(body) <= limit {
+			return "", nil
+		}
+
+		log.Printf("[DATA] %s sent %d bytes, exceeding the %s limit of %d\n",
+			c.RemoteAddr(), len(body), session, limit)
+
+		return fmt.Sprintf("552 5.3.4 %s Message size exceeds fixed limit of %d bytes", hostname, limit), nil
+	}
+}
+
+// executableCheck returns a dataCheck rejecting messages with an
+// attachment whose file name has one of the extensions in types, such as
+// ".exe", or whose media type is one of the others.
+func executableCheck(hostname string, types []string) dataCheck {
+	exts, mediaTypes := make(map[string]bool), make(map[string]bool)
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+		case strings.HasPrefix(t, "."):
+			exts[t] = true
+		default:
+			mediaTypes[t] = true
+		}
+	}
+
+	return func(c *conn, _ *transaction, body []byte) (string, []string) {
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return "", nil
+		}
+
+		var found *part
+		err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(p *part) error {
+			if !p.attachment() {
+				return nil
+			}
+			if exts[strings.ToLower(path.Ext(p.filename))] || mediaTypes[p.mediaType] {
+				found = p
+
+				return errExecutable
+			}
+
+			return nil
+		})
+		if err != errExecutable {
+			return "", nil
+		}
+
+		log.Printf("[DATA] %s sent executable attachment %q (%s)\n", c.RemoteAddr(), found.filename, found.mediaType)
+
+		return fmt.Sprintf("554 5.7.1 %s Executable attachment %q refused", hostname, found.filename), nil
+	}
+}
+
+// attachmentCheck returns a dataCheck rejecting messages with more than
+// maxCount attachments, or with an attachment whose decoded size exceeds
+// maxSize bytes.  A limit of 0 is unlimited.
+func attachmentCheck(hostname string, maxCount, maxSize int) dataCheck {
+	return func(c *conn, _ *transaction, body []byte) (string, []string) {
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return "", nil
+		}
+
+		var (
+			count int
+			reply string
+		)
+		err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(p *part) error {
+			if !p.attachment() {
+				return nil
+			}
+			count++
+
+			switch {
+			case maxSize > 0 && len(p.body) > maxSize:
+				log.Printf("[DATA] %s sent attachment %q of %d bytes, exceeding %d\n",
+					c.RemoteAddr(), p.filename, len(p.body), maxSize)
+				reply = fmt.Sprintf("552 5.3.4 %s Attachment %q exceeds the limit of %d bytes",
+					hostname, p.filename, maxSize)
+			case maxCount > 0 && count > maxCount:
+				log.Printf("[DATA] %s sent more than %d attachments\n", c.RemoteAddr(), maxCount)
+				reply = fmt.Sprintf("552 5.3.4 %s Too many attachments, the limit is %d", hostname, maxCount)
+			default:
+				return nil
+			}
+
+			return errAttachmentLimit
+		})
+		if err != errAttachmentLimit {
+			return "", nil
+		}
+
+		return reply, nil
+	}
+}
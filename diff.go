@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffMessage is a parsed message file being compared.
+type diffMessage struct {
+	file   string
+	header mail.Header
+	parts  []*part
+}
+
+// diffCmd implements the diff subcommand.  It exits with status 1 if
+// the directories' messages differ.
+func diffCmd(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	ext := fs.String("extension", "eml", "Saved file extension")
+	ignore := fs.String("ignore", "Date,Message-ID,Received", "comma-separated headers to ignore")
+	unarmor := fs.Bool("dearmor", false, "decode files stored with -armor")
+	pairBy := fs.String("pair-by", "subject", "pair messages by subject (Subject and To) or message-id")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] dir1 dir2\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var key func(*diffMessage) string
+	switch *pairBy {
+	case "subject":
+		key = func(m *diffMessage) string {
+			return m.header.Get("Subject") + "\x00" + m.header.Get("To")
+		}
+	case "message-id":
+		key = func(m *diffMessage) string { return m.header.Get("Message-Id") }
+	default:
+		log.Fatalf("Unknown -pair-by %q\n", *pairBy)
+	}
+
+	ignored := make(map[string]bool)
+	for _, h := range strings.Split(*ignore, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			ignored[textproto.CanonicalMIMEHeaderKey(h)] = true
+		}
+	}
+
+	a, err := readDiffDir(fs.Arg(0), *ext, *unarmor)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	b, err := readDiffDir(fs.Arg(1), *ext, *unarmor)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	differ := diffDirs(w, a, b, key, ignored)
+	if err = w.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if differ {
+		os.Exit(1)
+	}
+}
+
+// readDiffDir parses all message files in dir, in file name order,
+// decoding them first if armored is set.
+func readDiffDir(dir, ext string, armored bool) ([]*diffMessage, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*."+ext))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	msgs := make([]*diffMessage, 0, len(files))
+	for _, file := range files {
+		data, err := readMessageFile(file, armored)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+
+		m := &diffMessage{file: file, header: msg.Header}
+		err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(p *part) error {
+			m.parts = append(m.parts, p)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+// diffDirs pairs the messages in a and b by key and writes their
+// differences to w.  It reports whether any were found.
+func diffDirs(w io.Writer, a, b []*diffMessage, key func(*diffMessage) string,
+	ignored map[string]bool) bool {
+	pending := make(map[string][]*diffMessage)
+	for _, m := range b {
+		k := key(m)
+		pending[k] = append(pending[k], m)
+	}
+
+	var differ bool
+	for _, ma := range a {
+		k := key(ma)
+		if len(pending[k]) == 0 {
+			fmt.Fprintf(w, "Only in %s: %s\n", filepath.Dir(ma.file), filepath.Base(ma.file))
+			differ = true
+
+			continue
+		}
+		mb := pending[k][0]
+		pending[k] = pending[k][1:]
+
+		if diffMessages(w, ma, mb, ignored) {
+			differ = true
+		}
+	}
+
+	for _, m := range b {
+		if ms := pending[key(m)]; len(ms) > 0 && ms[0] == m {
+			pending[key(m)] = ms[1:]
+			fmt.Fprintf(w, "Only in %s: %s\n", filepath.Dir(m.file), filepath.Base(m.file))
+			differ = true
+		}
+	}
+
+	return differ
+}
+
+// diffMessages writes the differences between a and b to w and reports
+// whether there were any.
+func diffMessages(w io.Writer, a, b *diffMessage, ignored map[string]bool) bool {
+	var diffs []string
+
+	keys := make(map[string]bool)
+	for k := range a.header {
+		keys[k] = true
+	}
+	for k := range b.header {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		if !ignored[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		va, vb := diffHeader(k, a.header[k]), diffHeader(k, b.header[k])
+		if va != vb {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", k, va, vb))
+		}
+	}
+
+	if len(a.parts) != len(b.parts) {
+		diffs = append(diffs, fmt.Sprintf("%d parts != %d parts", len(a.parts), len(b.parts)))
+	}
+	for i := 0; i < len(a.parts) && i < len(b.parts); i++ {
+		pa, pb := a.parts[i], b.parts[i]
+		switch {
+		case pa.mediaType != pb.mediaType:
+			diffs = append(diffs, fmt.Sprintf("part %d: type %s != %s", i+1, pa.mediaType, pb.mediaType))
+		case !bytes.Equal(pa.body, pb.body):
+			diffs = append(diffs, fmt.Sprintf("part %d (%s): %s", i+1, pa.mediaType, firstDifference(pa, pb)))
+		}
+	}
+
+	if len(diffs) == 0 {
+		return false
+	}
+
+	fmt.Fprintf(w, "%s <> %s\n", a.file, b.file)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+
+	return true
+}
+
+// diffHeader returns the comparable value of header k.  Multipart
+// boundaries are generated per message, so they're left out.
+func diffHeader(k string, values []string) string {
+	v := strings.Join(values, "\n")
+	if k != "Content-Type" {
+		return v
+	}
+
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return v
+	}
+	delete(params, "boundary")
+
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// firstDifference describes where the bodies of a and b first differ.
+func firstDifference(a, b *part) string {
+	if !strings.HasPrefix(a.mediaType, "text/") {
+		return fmt.Sprintf("content differs (%d bytes, %d bytes)", len(a.body), len(b.body))
+	}
+
+	la := strings.Split(strings.ReplaceAll(string(a.body), "\r\n", "\n"), "\n")
+	lb := strings.Split(strings.ReplaceAll(string(b.body), "\r\n", "\n"), "\n")
+	for i := 0; i < len(la) || i < len(lb); i++ {
+		var sa, sb string
+		if i < len(la) {
+			sa = la[i]
+		}
+		if i < len(lb) {
+			sb = lb[i]
+		}
+		if sa != sb || i >= len(la) || i >= len(lb) {
+			return fmt.Sprintf("line %d: %q != %q", i+1, sa, sb)
+		}
+	}
+
+	return "line endings differ"
+}
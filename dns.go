@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// configureResolver points net.DefaultResolver, which every lookup uses,
+// including the smtpd server's reverse lookups of clients, at the DNS
+// server at addr, with port 53 if it has none, rather than the system's
+// resolvers.  Each query exchange is bounded by timeout.  If addr isn't
+// set, the default resolver is left as it is.
+func configureResolver(addr string, timeout time.Duration) {
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	net.DefaultResolver.PreferGo = true
+	net.DefaultResolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, c.SetDeadline(time.Now().Add(timeout))
+	}
+}
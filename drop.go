@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// dropStages are the points in the conversation at which -drop-rate
+// drops a connection.
+var dropStages = []string{"greeting", "rcpt", "data"}
+
+var errDropped = errors.New("dropped by -drop-rate")
+
+// connDrops picks the connections to drop, and where, for -drop-rate.
+// Picks come from a single seeded source, so with the same -drop-seed the
+// same sequence of connections is dropped at the same points.
+type connDrops struct {
+	rate float64 // fraction of connections dropped
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// newConnDrops returns drops of the fraction rate of connections, picked
+// by a source seeded with seed.
+func newConnDrops(rate float64, seed int64) *connDrops {
+	return &connDrops{rate: rate, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// pick returns the stage at which to drop the next connection, or "" to
+// leave it be.
+func (d *connDrops) pick() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rnd.Float64() >= d.rate {
+		return ""
+	}
+
+	return dropStages[d.rnd.Intn(len(dropStages))]
+}
+
+// dropDue reports whether the connection should be dropped on reading
+// the client line just passed to command.
+func (c *conn) dropDue() bool {
+	switch c.drop {
+	case "rcpt":
+		return !c.data && c.verb() == "RCPT"
+	case "data":
+		return c.data
+	}
+
+	return false
+}
+
+// dropNow drops the connection without a reply, resetting it if it's a
+// TCP connection, and fails the server's following Reads.
+func (c *conn) dropNow(where string) {
+	log.Printf("[DROP] %s dropped %s\n", c.RemoteAddr(), where)
+
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Conn.Close()
+
+	c.drop = ""
+	c.early = nil
+	c.err = errDropped
+}
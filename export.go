@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receivedIPRE matches the bracketed remote IP in the Received header added
+// by the smtpd server.
+var receivedIPRE = regexp.MustCompile(`^from .*?\[([^\]]+)\]`)
+
+// exportCSVCmd implements the export-csv subcommand.
+func exportCSVCmd(args []string) {
+	fs := flag.NewFlagSet("export-csv", flag.ExitOnError)
+	dir := fs.String("output", "", "Output directory (default to current directory)")
+	ext := fs.String("extension", "eml", "Saved file extension")
+	algo := fs.String("hash-algo", "sha256", "content hash algorithm: sha256 or sha512")
+	unarmor := fs.Bool("dearmor", false, "decode files stored with -armor")
+	_ = fs.Parse(args)
+
+	h, err := parseHashAlgo(*algo)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *dir == "" {
+		*dir, err = os.Getwd()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err = exportCSV(os.Stdout, *dir, *ext, h, *unarmor); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// exportCSV writes a CSV row of metadata to w for every message file in
+// dir with extension ext.  Rows are written as each file is read.  The
+// last column holds the file's digest and is named for h.  If armored is
+// set, the files are decoded first, so the size and digest are those of
+// the message.
+func exportCSV(w io.Writer, dir, ext string, h hashAlgo, armored bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	header := []string{"file", "received_at", "remote_ip", "from", "to", "subject", "size", h.name}
+	if err = cw.Write(header); err != nil {
+		return err
+	}
+
+	suffix := "." + ext
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), suffix) {
+			continue
+		}
+
+		data, err := readMessageFile(filepath.Join(dir, fi.Name()), armored)
+		if err != nil {
+			return err
+		}
+
+		row := []string{fi.Name(), fi.ModTime().UTC().Format(time.RFC3339), "", "", "", "",
+			strconv.Itoa(len(data)), h.sum(data)}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err == nil {
+			if received, ip := parseReceived(msg.Header.Get("Received")); ip != "" {
+				row[1] = received.UTC().Format(time.RFC3339)
+				row[2] = ip
+			}
+			row[3] = msg.Header.Get("From")
+			row[4] = msg.Header.Get("To")
+			row[5] = msg.Header.Get("Subject")
+		}
+
+		if err = cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// parseReceived returns the receive time and remote IP from a Received
+// header added by the smtpd server.  It returns an empty IP if the header
+// isn't in the expected form.
+func parseReceived(header string) (time.Time, string) {
+	m := receivedIPRE.FindStringSubmatch(header)
+	if m == nil {
+		return time.Time{}, ""
+	}
+
+	i := strings.LastIndexByte(header, ';')
+	if i == -1 {
+		return time.Time{}, ""
+	}
+	t, err := mail.ParseDate(strings.TrimSpace(header[i+1:]))
+	if err != nil {
+		return time.Time{}, ""
+	}
+
+	return t, m[1]
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitCommitter commits saved messages to a Git repository.  Messages are
+// batched and committed together every interval so a busy server doesn't
+// create a commit per message.
+type gitCommitter struct {
+	repo     string
+	author   string
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []gitEntry
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type gitEntry struct {
+	file    string
+	from    string
+	subject string
+}
+
+// newGitCommitter returns a gitCommitter for the work tree containing
+// repo, which must also contain dir.
+func newGitCommitter(repo, dir, hostname string, interval time.Duration) (*gitCommitter, error) {
+	out, err := exec.Command("git", "-C", repo, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a Git repository: %v", repo, err)
+	}
+	top := strings.TrimSpace(string(out))
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(top, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("output directory %s is outside of Git repository %s", dir, top)
+	}
+
+	gc := &gitCommitter{
+		repo:     top,
+		author:   "smtpdump@" + hostname,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+
+	gc.wg.Add(1)
+	go gc.run()
+
+	return gc, nil
+}
+
+// add queues file for the next commit.
+func (gc *gitCommitter) add(file, from, subject string) {
+	gc.mu.Lock()
+	gc.pending = append(gc.pending, gitEntry{file: file, from: from, subject: subject})
+	gc.mu.Unlock()
+}
+
+// Close commits any pending messages and stops the committer.
+func (gc *gitCommitter) Close() {
+	close(gc.done)
+	gc.wg.Wait()
+}
+
+func (gc *gitCommitter) run() {
+	defer gc.wg.Done()
+
+	t := time.NewTicker(gc.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			gc.commit()
+		case <-gc.done:
+			gc.commit()
+			return
+		}
+	}
+}
+
+// commit stages and commits all pending messages.
+func (gc *gitCommitter) commit() {
+	gc.mu.Lock()
+	entries := gc.pending
+	gc.pending = nil
+	gc.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, e.file)
+	}
+	if err := gc.git(append([]string{"add", "--"}, files...)...); err != nil {
+		log.Println(err)
+
+		return
+	}
+
+	var msg string
+	if len(entries) == 1 {
+		msg = fmt.Sprintf("Add message from %s: %s", entries[0].from, entries[0].subject)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Add %d messages\n\n", len(entries))
+		for _, e := range entries {
+			fmt.Fprintf(&b, "%s: from %s: %s\n", filepath.Base(e.file), e.from, e.subject)
+		}
+		msg = b.String()
+	}
+
+	if err := gc.git(append([]string{"commit", "--quiet", "-m", msg, "--"}, files...)...); err != nil {
+		log.Println(err)
+
+		return
+	}
+
+	log.Printf("Committed %d message(s) to %q\n", len(entries), gc.repo)
+}
+
+func (gc *gitCommitter) git(args ...string) error {
+	sub := args[0]
+	args = append([]string{"-C", gc.repo, "-c", "user.name=SMTPDump",
+		"-c", "user.email=" + gc.author}, args...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", sub, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return nil
+}
@@ -6,3 +6,5 @@ require (
 	github.com/fatih/color v1.9.0
 	github.com/mhale/smtpd v0.0.0-20200509114310-d7a07f752336
 )
+
+replace github.com/mhale/smtpd => ./third_party/smtpd
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupLinger is how long a connection's group waits after the connection
+// closes before it's written, so messages still being handled join it.
+const groupLinger = 2 * time.Second
+
+// mboxFromRE matches the lines of a message that mboxrd quotes with ">".
+var mboxFromRE = regexp.MustCompile(`^>*From `)
+
+// connGroups collects the messages received on each connection and writes
+// them to one mbox file per connection, in arrival order, once the
+// connection closes.
+type connGroups struct {
+	dir     string
+	verbose bool
+	gc      *gitCommitter // if set, saved files are queued for commit
+	slots   fileSlots     // if set, limits the files open at once
+
+	mu sync.Mutex
+	m  map[string][]*message // keyed by remote address
+}
+
+// newConnGroups returns groups writing mbox files to dir.
+func newConnGroups(dir string, verbose bool, gc *gitCommitter, slots fileSlots) *connGroups {
+	return &connGroups{dir: dir, verbose: verbose, gc: gc, slots: slots, m: make(map[string][]*message)}
+}
+
+// sink returns a sink that adds messages to their connection's group.
+func (g *connGroups) sink() sink {
+	return sink{name: "group", deliver: g.deliver}
+}
+
+func (g *connGroups) deliver(msg *message) error {
+	key := msg.origin.String()
+
+	g.mu.Lock()
+	g.m[key] = append(g.m[key], msg)
+	g.mu.Unlock()
+
+	// The connection may have closed while the message was being handled.
+	if lookupConn(msg.origin) == nil {
+		g.closed(msg.origin)
+	}
+
+	return nil
+}
+
+// closed schedules the group of the connection from addr to be written.
+func (g *connGroups) closed(addr net.Addr) {
+	key := addr.String()
+	time.AfterFunc(groupLinger, func() { g.flush(key) })
+}
+
+// flush writes and discards the group of the connection from key, if any.
+func (g *connGroups) flush(key string) {
+	g.mu.Lock()
+	msgs := g.m[key]
+	delete(g.m, key)
+	g.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	if err := g.write(key, msgs); err != nil {
+		log.Printf("[group] %s: %v\n", key, err)
+	}
+}
+
+// write writes msgs, received from the connection from key, to a new
+// mbox file named for the time of the first message and the remote
+// address.
+func (g *connGroups) write(key string, msgs []*message) error {
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].received.Before(msgs[j].received) })
+
+	defer g.slots.acquire()()
+
+	remote := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(key)
+	f, err := randFile(g.dir, fmt.Sprintf("%d_%s", msgs[0].received.UnixNano(), remote), "mbox")
+	if err != nil {
+		return err
+	}
+
+	openFiles.add(1)
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		writeMboxMessage(w, msg)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	openFiles.add(-1)
+	if err != nil {
+		return err
+	}
+
+	if g.verbose {
+		log.Printf("Wrote %d messages from %s to %q\n", len(msgs), key, f.Name())
+	}
+
+	if g.gc != nil {
+		g.gc.add(f.Name(), msgs[0].from, fmt.Sprintf("%d messages from %s", len(msgs), key))
+	}
+
+	return nil
+}
+
+// Close writes every group, whether or not its connection has closed.
+func (g *connGroups) Close() {
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.m))
+	for key := range g.m {
+		keys = append(keys, key)
+	}
+	g.mu.Unlock()
+
+	for _, key := range keys {
+		g.flush(key)
+	}
+}
+
+// writeMboxMessage writes msg to w in mboxrd format: a "From " line with
+// the envelope sender and time of receipt, then the message with LF line
+// endings and its "From " lines quoted, then a blank line.
+func writeMboxMessage(w *bufio.Writer, msg *message) {
+	from := msg.from
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	fmt.Fprintf(w, "From %s %s\n", from, msg.received.UTC().Format(time.ANSIC))
+
+	data := bytes.ReplaceAll(msg.data, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if mboxFromRE.Match(line) {
+			_ = w.WriteByte('>')
+		}
+		_, _ = w.Write(line)
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		_ = w.WriteByte('\n')
+	}
+	_ = w.WriteByte('\n')
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+var (
+	handshakesActive  = newGauge("smtpdump_tls_handshakes", "Number of TLS handshakes in progress.")
+	handshakesWaiting = newGauge("smtpdump_tls_handshakes_waiting", "Number of TLS handshakes waiting for -max-handshakes.")
+)
+
+// handshakeLimit bounds the number of concurrent TLS handshakes.  A
+// handshake takes a slot once the client's hello has been read, before
+// the expensive key exchange, and waits for one if none are free.
+type handshakeLimit struct {
+	slots chan struct{}
+}
+
+// limit returns a GetConfigForClient callback that takes a handshake slot
+// for each client, then returns the config next selects for it, if any.
+// The slot is released by the client's conn when the handshake succeeds
+// or fails, or the connection closes.
+func (h *handshakeLimit) limit(
+	next func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		release := h.acquire()
+		if c, ok := hello.Conn.(*conn); ok {
+			c.handshake = release
+		}
+
+		if next == nil {
+			return nil, nil
+		}
+
+		return next(hello)
+	}
+}
+
+// acquire waits for a free slot and returns the function releasing it,
+// which may be called more than once.
+func (h *handshakeLimit) acquire() func() {
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		handshakesWaiting.add(1)
+		h.slots <- struct{}{}
+		handshakesWaiting.add(-1)
+	}
+	handshakesActive.add(1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			handshakesActive.add(-1)
+			<-h.slots
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto"
+	_ "crypto/sha256" // register crypto.SHA256
+	_ "crypto/sha512" // register crypto.SHA512
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hashAlgos maps -hash-algo names to hash functions.  Each must have its
+// implementation linked into the binary.
+var hashAlgos = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// hashAlgo is the hash function used wherever smtpdump hashes content.
+type hashAlgo struct {
+	name string
+	hash crypto.Hash
+}
+
+// parseHashAlgo returns the named hash function or an error if it's
+// unknown.
+func parseHashAlgo(name string) (hashAlgo, error) {
+	h, ok := hashAlgos[name]
+	if !ok {
+		names := make([]string, 0, len(hashAlgos))
+		for n := range hashAlgos {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return hashAlgo{}, fmt.Errorf("unknown hash algorithm %q (want one of %s)",
+			name, strings.Join(names, ", "))
+	}
+
+	return hashAlgo{name: name, hash: h}, nil
+}
+
+// sum returns the hex-encoded digest of data.
+func (a hashAlgo) sum(data []byte) string {
+	h := a.hash.New()
+	_, _ = h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/pprof"
+)
+
+// httpHandler returns the handler for -http-addr, serving the health
+// check, metrics, the API and pprof under distinct path prefixes.
+func httpHandler(a *api) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/api/", http.StripPrefix("/api", a.handler("/api")))
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// healthz reports that the process is up.
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	imapTimeout    = 30 * time.Minute // RFC 3501's minimum autologout timer
+	imapMaxLiteral = 1 << 20          // bytes of literals per command
+	imapMaxLine    = 64 << 10         // bytes of a command line, besides its literals
+
+	imapDateLayout       = "02-Jan-2006 15:04:05 -0700"
+	imapSearchDateLayout = "2-Jan-2006"
+	imapCapability       = "IMAP4rev1 LITERAL+"
+)
+
+var (
+	errIMAPSyntax  = errors.New("syntax error")
+	errIMAPTooLong = errors.New("command too long")
+)
+
+// imapServer is a minimal read-only IMAP4rev1 server exposing the message
+// files in a directory as a single INBOX.  It supports enough of RFC 3501
+// for test clients to log in, select the INBOX, and search and fetch
+// messages: any credentials are accepted, no flags are kept, and
+// BODYSTRUCTURE isn't supported.
+type imapServer struct {
+	dir      string
+	ext      string
+	armored  bool   // files are stored with -armor
+	validity uint32 // UIDVALIDITY, unique to this run
+}
+
+func newIMAPServer(dir, ext string, armored bool) *imapServer {
+	return &imapServer{dir: dir, ext: ext, armored: armored, validity: uint32(time.Now().Unix())}
+}
+
+// listenAndServe listens on addr and serves IMAP connections until it
+// fails.
+func (s *imapServer) listenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[IMAP] %s: panic: %v\n", c.RemoteAddr(), r)
+					_ = c.Close()
+				}
+			}()
+
+			sess := &imapSession{
+				srv:  s,
+				conn: c,
+				r:    bufio.NewReader(c),
+				w:    bufio.NewWriter(c),
+				uids: make(map[string]uint32),
+				next: 1,
+			}
+			if err := sess.run(); err != nil && err != io.EOF {
+				log.Printf("[IMAP] %s: %v\n", c.RemoteAddr(), err)
+			}
+			_ = c.Close()
+		}()
+	}
+}
+
+// imapMessage is a message file in the INBOX.
+type imapMessage struct {
+	uid      uint32
+	file     string
+	received time.Time
+}
+
+type imapSession struct {
+	srv  *imapServer
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	authed   bool
+	selected bool
+	msgs     []*imapMessage    // in sequence number order
+	uids     map[string]uint32 // by file name
+	next     uint32            // next UID
+
+	lineLeft    int // bytes the command line being read may still take
+	literalLeft int // bytes its literals may still take
+}
+
+func (s *imapSession) run() error {
+	s.printf("* OK %s SMTPDump IMAP4rev1 read-only service ready", hostname)
+
+	for {
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		_ = s.conn.SetReadDeadline(time.Now().Add(imapTimeout))
+
+		args, err := s.readCommand()
+		if err == errIMAPTooLong {
+			s.printf("* BYE Command too long")
+			_ = s.w.Flush()
+
+			return err
+		}
+		if err == errIMAPSyntax {
+			s.printf("* BAD Syntax error")
+
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(args) < 2 {
+			s.printf("* BAD Missing command")
+
+			continue
+		}
+
+		tag, cmd := imapString(args[0]), strings.ToUpper(imapString(args[1]))
+		if cmd == "LOGOUT" {
+			s.printf("* BYE Logging out")
+			s.printf("%s OK LOGOUT completed", tag)
+
+			return s.w.Flush()
+		}
+
+		if err = s.command(tag, cmd, args[2:]); err != nil {
+			s.printf("%s BAD %v", tag, err)
+		}
+	}
+}
+
+// command carries out the command cmd with arguments args.  It returns an
+// error for commands that are malformed or unsupported.
+func (s *imapSession) command(tag, cmd string, args []interface{}) error {
+	switch cmd {
+	case "CAPABILITY":
+		s.printf("* CAPABILITY %s", imapCapability)
+	case "NOOP", "CHECK":
+		s.refresh(true)
+	case "LOGIN":
+		if len(args) != 2 {
+			return errIMAPSyntax
+		}
+		s.authed = true
+		log.Printf("[IMAP] Login %q from %s\n", imapString(args[0]), s.conn.RemoteAddr())
+	case "AUTHENTICATE":
+		s.printf("%s NO Use LOGIN", tag)
+
+		return nil
+	default:
+		if !s.authed {
+			s.printf("%s NO Not logged in", tag)
+
+			return nil
+		}
+
+		return s.authedCommand(tag, cmd, args)
+	}
+
+	s.printf("%s OK %s completed", tag, cmd)
+
+	return nil
+}
+
+func (s *imapSession) authedCommand(tag, cmd string, args []interface{}) error {
+	switch cmd {
+	case "LIST", "LSUB":
+		if len(args) != 2 {
+			return errIMAPSyntax
+		}
+		switch strings.ToUpper(imapString(args[1])) {
+		case "*", "%", "INBOX":
+			s.printf(`* %s () "/" INBOX`, cmd)
+		case "":
+			s.printf(`* %s (\Noselect) "/" ""`, cmd)
+		}
+	case "SELECT", "EXAMINE":
+		if len(args) != 1 || !strings.EqualFold(imapString(args[0]), "INBOX") {
+			s.printf("%s NO No such mailbox", tag)
+
+			return nil
+		}
+		s.selected = true
+		s.msgs, s.uids, s.next = nil, make(map[string]uint32), 1
+		s.refresh(false)
+		s.printf(`* FLAGS (\Seen)`)
+		s.printf("* OK [PERMANENTFLAGS ()] Read-only mailbox")
+		s.printf("* %d EXISTS", len(s.msgs))
+		s.printf("* 0 RECENT")
+		s.printf("* OK [UIDVALIDITY %d] UIDs valid", s.srv.validity)
+		s.printf("* OK [UIDNEXT %d] Predicted next UID", s.next)
+		s.printf("%s OK [READ-ONLY] %s completed", tag, cmd)
+
+		return nil
+	case "STATUS":
+		if len(args) != 2 || !strings.EqualFold(imapString(args[0]), "INBOX") {
+			s.printf("%s NO No such mailbox", tag)
+
+			return nil
+		}
+		if !s.selected {
+			s.msgs, s.uids, s.next = nil, make(map[string]uint32), 1
+		}
+		s.refresh(false)
+		s.printf("* STATUS INBOX (MESSAGES %d RECENT 0 UIDNEXT %d UIDVALIDITY %d UNSEEN %d)",
+			len(s.msgs), s.next, s.srv.validity, len(s.msgs))
+	case "CLOSE", "UNSELECT":
+		s.selected = false
+	case "FETCH", "SEARCH":
+		return s.selectedCommand(tag, cmd, false, args)
+	case "UID":
+		if len(args) == 0 {
+			return errIMAPSyntax
+		}
+		sub := strings.ToUpper(imapString(args[0]))
+		if sub != "FETCH" && sub != "SEARCH" {
+			s.printf("%s NO Mailbox is read-only", tag)
+
+			return nil
+		}
+
+		return s.selectedCommand(tag, "UID "+sub, true, args[1:])
+	case "STORE", "COPY", "EXPUNGE", "APPEND", "CREATE", "DELETE", "RENAME":
+		s.printf("%s NO Mailbox is read-only", tag)
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported command %s", cmd)
+	}
+
+	s.printf("%s OK %s completed", tag, cmd)
+
+	return nil
+}
+
+func (s *imapSession) selectedCommand(tag, cmd string, uid bool, args []interface{}) error {
+	if !s.selected {
+		s.printf("%s NO No mailbox selected", tag)
+
+		return nil
+	}
+
+	var err error
+	if strings.HasSuffix(cmd, "FETCH") {
+		err = s.fetch(uid, args)
+	} else {
+		err = s.search(uid, args)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.printf("%s OK %s completed", tag, cmd)
+
+	return nil
+}
+
+// refresh adds message files that appeared since the last refresh to the
+// INBOX, reporting the new size if report is set.  Files are ordered by
+// modification time, so UIDs follow the order of arrival.
+func (s *imapSession) refresh(report bool) {
+	files, err := ioutil.ReadDir(s.srv.dir)
+	if err != nil {
+		log.Printf("[IMAP] %v\n", err)
+
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	n := len(s.msgs)
+	suffix := "." + s.srv.ext
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), suffix) {
+			continue
+		}
+		if _, ok := s.uids[fi.Name()]; ok {
+			continue
+		}
+
+		s.uids[fi.Name()] = s.next
+		s.msgs = append(s.msgs, &imapMessage{uid: s.next, file: fi.Name(), received: fi.ModTime()})
+		s.next++
+	}
+
+	if report && s.selected && len(s.msgs) != n {
+		s.printf("* %d EXISTS", len(s.msgs))
+	}
+}
+
+// selectMessages returns the messages in the sequence set, or the UID set
+// if uid is set, paired with their sequence numbers.
+func (s *imapSession) selectMessages(set string, uid bool) (map[int]*imapMessage, error) {
+	max := uint32(len(s.msgs))
+	if uid {
+		max = s.next - 1
+	}
+
+	ranges, err := parseIMAPSet(set, max)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[int]*imapMessage)
+	for i, m := range s.msgs {
+		n := uint32(i + 1)
+		if uid {
+			n = m.uid
+		}
+		if imapSetContains(ranges, n) {
+			selected[i+1] = m
+		}
+	}
+
+	return selected, nil
+}
+
+func (s *imapSession) load(m *imapMessage) ([]byte, error) {
+	return readMessageFile(filepath.Join(s.srv.dir, m.file), s.srv.armored)
+}
+
+// fetch implements FETCH and UID FETCH.
+func (s *imapSession) fetch(uid bool, args []interface{}) error {
+	if len(args) != 2 {
+		return errIMAPSyntax
+	}
+
+	selected, err := s.selectMessages(imapString(args[0]), uid)
+	if err != nil {
+		return err
+	}
+
+	var items []string
+	switch v := args[1].(type) {
+	case []interface{}:
+		for _, item := range v {
+			items = append(items, strings.ToUpper(imapString(item)))
+		}
+	default:
+		switch item := strings.ToUpper(imapString(v)); item {
+		case "ALL":
+			items = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			items = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			return errors.New("BODY structure isn't supported")
+		default:
+			items = []string{item}
+		}
+	}
+	if uid && !containsString(items, "UID") {
+		items = append([]string{"UID"}, items...)
+	}
+
+	seqs := make([]int, 0, len(selected))
+	for seq := range selected {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		m := selected[seq]
+		data, err := s.load(m)
+		if err != nil {
+			log.Printf("[IMAP] %v\n", err)
+			s.printf("* NO Message %d is unavailable", seq)
+
+			continue
+		}
+
+		var out bytes.Buffer
+		for i, item := range items {
+			if i > 0 {
+				out.WriteByte(' ')
+			}
+			if err = fetchItem(&out, item, m, data); err != nil {
+				return err
+			}
+		}
+		s.printf("* %d FETCH (%s)", seq, out.Bytes())
+	}
+
+	return nil
+}
+
+// fetchItem writes the FETCH response for item of message m, whose
+// content is data, to w.
+func fetchItem(w *bytes.Buffer, item string, m *imapMessage, data []byte) error {
+	header, body := splitMessage(data)
+
+	switch item {
+	case "UID":
+		fmt.Fprintf(w, "UID %d", m.uid)
+	case "FLAGS":
+		w.WriteString("FLAGS ()")
+	case "INTERNALDATE":
+		fmt.Fprintf(w, "INTERNALDATE %q", m.received.Format(imapDateLayout))
+	case "RFC822.SIZE":
+		fmt.Fprintf(w, "RFC822.SIZE %d", len(data))
+	case "ENVELOPE":
+		w.WriteString("ENVELOPE ")
+		writeEnvelope(w, header)
+	case "RFC822":
+		w.WriteString("RFC822 ")
+		writeLiteral(w, data)
+	case "RFC822.HEADER":
+		w.WriteString("RFC822.HEADER ")
+		writeLiteral(w, header)
+	case "RFC822.TEXT":
+		w.WriteString("RFC822.TEXT ")
+		writeLiteral(w, body)
+	default:
+		return fetchSection(w, item, header, body, data)
+	}
+
+	return nil
+}
+
+// fetchSection writes the response for a BODY[section]<partial> or
+// BODY.PEEK[section]<partial> item.
+func fetchSection(w *bytes.Buffer, item string, header, body, data []byte) error {
+	var rest string
+	switch {
+	case strings.HasPrefix(item, "BODY.PEEK["):
+		rest = item[len("BODY.PEEK["):]
+	case strings.HasPrefix(item, "BODY["):
+		rest = item[len("BODY["):]
+	default:
+		return fmt.Errorf("unsupported FETCH item %s", item)
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if end == -1 {
+		return errIMAPSyntax
+	}
+	section, partial := rest[:end], rest[end+1:]
+
+	var content []byte
+	switch {
+	case section == "":
+		content = data
+	case section == "HEADER":
+		content = header
+	case section == "TEXT":
+		content = body
+	case strings.HasPrefix(section, "HEADER.FIELDS.NOT "):
+		content = headerFields(header, section[len("HEADER.FIELDS.NOT "):], false)
+	case strings.HasPrefix(section, "HEADER.FIELDS "):
+		content = headerFields(header, section[len("HEADER.FIELDS "):], true)
+	default:
+		return fmt.Errorf("unsupported section %s", section)
+	}
+
+	fmt.Fprintf(w, "BODY[%s]", section)
+	if partial != "" {
+		var origin, count int
+		if _, err := fmt.Sscanf(partial, "<%d.%d>", &origin, &count); err != nil || origin < 0 || count < 0 {
+			return errIMAPSyntax
+		}
+		if origin > len(content) {
+			origin = len(content)
+		}
+		if count < len(content)-origin {
+			content = content[:origin+count]
+		}
+		content = content[origin:]
+		fmt.Fprintf(w, "<%d>", origin)
+	}
+	w.WriteByte(' ')
+	writeLiteral(w, content)
+
+	return nil
+}
+
+// splitMessage returns the header of data, including the blank line
+// ending it, and the body.  Without a blank line, data is all header.
+func splitMessage(data []byte) ([]byte, []byte) {
+	if i := headerEnd(data); i != -1 {
+		return data[:i], data[i:]
+	}
+
+	return data, nil
+}
+
+// headerFields returns the header fields named in the parenthesized list
+// names, or all other fields if include isn't set, followed by a blank
+// line.
+func headerFields(header []byte, names string, include bool) []byte {
+	want := make(map[string]bool)
+	for _, name := range strings.Fields(strings.Trim(names, "()")) {
+		want[strings.ToUpper(strings.Trim(name, `"`))] = true
+	}
+
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(line) == 0 || bytes.Equal(line, []byte("\r\n")) {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i != -1 {
+				name = line[:i]
+			}
+			keep = want[strings.ToUpper(string(bytes.TrimSpace(name)))] == include
+		}
+		if keep {
+			out.Write(line)
+		}
+	}
+	out.WriteString("\r\n")
+
+	return out.Bytes()
+}
+
+// writeEnvelope writes the ENVELOPE structure of the message with header
+// to w.
+func writeEnvelope(w *bytes.Buffer, header []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header[:len(header):len(header)], "\r\n"...)))
+	h := mail.Header{}
+	if err == nil {
+		h = msg.Header
+	}
+
+	addrs := func(key string) {
+		list, err := h.AddressList(key)
+		if err != nil || len(list) == 0 {
+			w.WriteString("NIL")
+
+			return
+		}
+
+		w.WriteByte('(')
+		for _, a := range list {
+			mailbox, host := a.Address, ""
+			if i := strings.LastIndexByte(a.Address, '@'); i != -1 {
+				mailbox, host = a.Address[:i], a.Address[i+1:]
+			}
+			w.WriteByte('(')
+			writeNString(w, a.Name)
+			w.WriteString(" NIL ")
+			writeNString(w, mailbox)
+			w.WriteByte(' ')
+			writeNString(w, host)
+			w.WriteByte(')')
+		}
+		w.WriteByte(')')
+	}
+	from := "From"
+	if h.Get(from) == "" {
+		from = "Sender"
+	}
+
+	w.WriteByte('(')
+	writeNString(w, h.Get("Date"))
+	w.WriteByte(' ')
+	writeNString(w, h.Get("Subject"))
+	for _, key := range []string{"From", "Sender", "Reply-To"} {
+		w.WriteByte(' ')
+		if h.Get(key) == "" {
+			key = from
+		}
+		addrs(key)
+	}
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		w.WriteByte(' ')
+		addrs(key)
+	}
+	w.WriteByte(' ')
+	writeNString(w, h.Get("In-Reply-To"))
+	w.WriteByte(' ')
+	writeNString(w, h.Get("Message-Id"))
+	w.WriteByte(')')
+}
+
+// writeNString writes s to w as a quoted string, a literal if it can't be
+// quoted, or NIL if it's empty.
+func writeNString(w *bytes.Buffer, s string) {
+	switch {
+	case s == "":
+		w.WriteString("NIL")
+	case strings.ContainsAny(s, "\r\n\x00") || strings.IndexFunc(s, func(r rune) bool { return r > 0x7f }) != -1:
+		writeLiteral(w, []byte(s))
+	default:
+		w.WriteString(`"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`)
+	}
+}
+
+func writeLiteral(w *bytes.Buffer, b []byte) {
+	fmt.Fprintf(w, "{%d}\r\n", len(b))
+	w.Write(b)
+}
+
+// search implements SEARCH and UID SEARCH.
+func (s *imapSession) search(uid bool, args []interface{}) error {
+	if len(args) >= 2 && strings.EqualFold(imapString(args[0]), "CHARSET") {
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return errIMAPSyntax
+	}
+
+	var found []string
+	for i, m := range s.msgs {
+		data, err := s.load(m)
+		if err != nil {
+			log.Printf("[IMAP] %v\n", err)
+
+			continue
+		}
+
+		sm := &searchMessage{seq: uint32(i + 1), maxSeq: uint32(len(s.msgs)), maxUID: s.next - 1, msg: m, data: data}
+		ok, err := sm.matchAll(args)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		n := sm.seq
+		if uid {
+			n = m.uid
+		}
+		found = append(found, strconv.FormatUint(uint64(n), 10))
+	}
+
+	s.printf("* SEARCH %s", strings.Join(found, " "))
+
+	return nil
+}
+
+// searchMessage evaluates SEARCH criteria against one message.
+type searchMessage struct {
+	seq, maxSeq, maxUID uint32
+	msg                 *imapMessage
+	data                []byte
+	header              mail.Header
+}
+
+// matchAll reports whether the message matches all the search keys in
+// args.
+func (m *searchMessage) matchAll(args []interface{}) (bool, error) {
+	for len(args) > 0 {
+		ok, n, err := m.match(args)
+		if err != nil || !ok {
+			return false, err
+		}
+		args = args[n:]
+	}
+
+	return true, nil
+}
+
+// match reports whether the message matches the first search key in args
+// and how many arguments the key consumed.
+func (m *searchMessage) match(args []interface{}) (bool, int, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		ok, err := m.matchAll(list)
+
+		return ok, 1, err
+	}
+
+	key := strings.ToUpper(imapString(args[0]))
+	arg := func(i int) (string, error) {
+		if len(args) <= i {
+			return "", errIMAPSyntax
+		}
+
+		return imapString(args[i]), nil
+	}
+
+	switch key {
+	case "ALL", "UNSEEN", "NEW", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNANSWERED":
+		return true, 1, nil
+	case "SEEN", "OLD", "RECENT", "DELETED", "DRAFT", "FLAGGED", "ANSWERED":
+		return false, 1, nil
+	case "NOT":
+		if len(args) < 2 {
+			return false, 0, errIMAPSyntax
+		}
+		ok, n, err := m.match(args[1:])
+
+		return !ok, n + 1, err
+	case "OR":
+		if len(args) < 3 {
+			return false, 0, errIMAPSyntax
+		}
+		a, n, err := m.match(args[1:])
+		if err != nil {
+			return false, 0, err
+		}
+		if len(args) < n+2 {
+			return false, 0, errIMAPSyntax
+		}
+		b, k, err := m.match(args[1+n:])
+
+		return a || b, 1 + n + k, err
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		v, err := arg(1)
+
+		return m.headerContains(key, v), 2, err
+	case "HEADER":
+		field, err := arg(1)
+		if err != nil {
+			return false, 0, err
+		}
+		v, err := arg(2)
+
+		return m.headerContains(field, v), 3, err
+	case "BODY", "TEXT":
+		v, err := arg(1)
+		content := m.data
+		if key == "BODY" {
+			_, content = splitMessage(m.data)
+		}
+
+		return bytes.Contains(bytes.ToLower(content), bytes.ToLower([]byte(v))), 2, err
+	case "LARGER", "SMALLER":
+		v, err := arg(1)
+		if err != nil {
+			return false, 0, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return false, 0, errIMAPSyntax
+		}
+		if key == "LARGER" {
+			return len(m.data) > n, 2, nil
+		}
+
+		return len(m.data) < n, 2, nil
+	case "BEFORE", "ON", "SINCE":
+		v, err := arg(1)
+		if err != nil {
+			return false, 0, err
+		}
+		d, err := time.Parse(imapSearchDateLayout, v)
+		if err != nil {
+			return false, 0, errIMAPSyntax
+		}
+		r := m.msg.received
+		day := time.Date(r.Year(), r.Month(), r.Day(), 0, 0, 0, 0, time.UTC)
+		switch key {
+		case "BEFORE":
+			return day.Before(d), 2, nil
+		case "ON":
+			return day.Equal(d), 2, nil
+		}
+
+		return !day.Before(d), 2, nil
+	case "UID":
+		v, err := arg(1)
+		if err != nil {
+			return false, 0, err
+		}
+		ranges, err := parseIMAPSet(v, m.maxUID)
+
+		return err == nil && imapSetContains(ranges, m.msg.uid), 2, err
+	}
+
+	ranges, err := parseIMAPSet(key, m.maxSeq)
+	if err != nil {
+		return false, 0, fmt.Errorf("unsupported search key %s", key)
+	}
+
+	return imapSetContains(ranges, m.seq), 1, nil
+}
+
+// headerContains reports whether the header field contains v, ignoring
+// case, after decoding any encoded words.
+func (m *searchMessage) headerContains(field, v string) bool {
+	if m.header == nil {
+		m.header = mail.Header{}
+		header, _ := splitMessage(m.data)
+		if msg, err := mail.ReadMessage(bytes.NewReader(header)); err == nil {
+			m.header = msg.Header
+		}
+	}
+
+	dec := new(mime.WordDecoder)
+	for _, value := range m.header[textproto.CanonicalMIMEHeaderKey(field)] {
+		if decoded, err := dec.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		if strings.Contains(strings.ToLower(value), strings.ToLower(v)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIMAPSet parses an IMAP sequence set, in which "*" stands for max.
+func parseIMAPSet(set string, max uint32) ([][2]uint32, error) {
+	num := func(s string) (uint32, error) {
+		if s == "*" {
+			return max, nil
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || n == 0 {
+			return 0, errIMAPSyntax
+		}
+
+		return uint32(n), nil
+	}
+
+	var ranges [][2]uint32
+	for _, r := range strings.Split(set, ",") {
+		bounds := strings.SplitN(r, ":", 2)
+		lo, err := num(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = num(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		ranges = append(ranges, [2]uint32{lo, hi})
+	}
+
+	return ranges, nil
+}
+
+func imapSetContains(ranges [][2]uint32, n uint32) bool {
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *imapSession) printf(format string, a ...interface{}) {
+	fmt.Fprintf(s.w, format+"\r\n", a...)
+}
+
+// imapString returns the string value of a parsed argument, or "" for a
+// list.
+func imapString(arg interface{}) string {
+	s, _ := arg.(string)
+
+	return s
+}
+
+// readCommand reads and parses one command line into its arguments:
+// atoms, quoted strings and literals as strings, and parenthesized lists
+// as []interface{}.  Atoms keep bracketed sections, such as
+// BODY[HEADER.FIELDS (FROM)]<0.100>, whole.
+// Commands longer than imapMaxLine bytes, or with more than
+// imapMaxLiteral bytes of literals, fail with errIMAPTooLong.
+func (s *imapSession) readCommand() ([]interface{}, error) {
+	s.lineLeft, s.literalLeft = imapMaxLine, imapMaxLiteral
+
+	args, err := s.readList(false)
+	if err == errIMAPSyntax {
+		// Discard the rest of the line.
+		for {
+			c, rerr := s.readByte()
+			if rerr != nil {
+				return nil, rerr
+			}
+			if c == '\n' {
+				break
+			}
+		}
+	}
+
+	return args, err
+}
+
+// readByte reads the next byte of the command line, failing with
+// errIMAPTooLong once the line exceeds imapMaxLine bytes.
+func (s *imapSession) readByte() (byte, error) {
+	if s.lineLeft <= 0 {
+		return 0, errIMAPTooLong
+	}
+	s.lineLeft--
+
+	return s.r.ReadByte()
+}
+
+// unreadByte unreads the byte last read by readByte.
+func (s *imapSession) unreadByte() {
+	if s.r.UnreadByte() == nil {
+		s.lineLeft++
+	}
+}
+
+func (s *imapSession) readList(nested bool) ([]interface{}, error) {
+	var args []interface{}
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch c {
+		case ' ':
+		case '\r':
+			if c, err = s.readByte(); err != nil {
+				return nil, err
+			}
+			if c != '\n' {
+				return nil, errIMAPSyntax
+			}
+			fallthrough
+		case '\n':
+			if nested {
+				// Leave the line end for readCommand to discard up to.
+				s.unreadByte()
+
+				return nil, errIMAPSyntax
+			}
+
+			return args, nil
+		case '(':
+			list, err := s.readList(true)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, list)
+		case ')':
+			if !nested {
+				return nil, errIMAPSyntax
+			}
+
+			return args, nil
+		case '"':
+			str, err := s.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, str)
+		case '{':
+			lit, err := s.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, lit)
+		default:
+			s.unreadByte()
+			atom, err := s.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, atom)
+		}
+	}
+}
+
+func (s *imapSession) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.readByte()
+		switch {
+		case err != nil:
+			return "", err
+		case c == '"':
+			return b.String(), nil
+		case c == '\\':
+			if c, err = s.readByte(); err != nil {
+				return "", err
+			}
+		case c == '\r' || c == '\n':
+			s.unreadByte()
+
+			return "", errIMAPSyntax
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (s *imapSession) readLiteral() (string, error) {
+	spec, err := s.readUntil('}')
+	if err != nil {
+		return "", err
+	}
+	sync := !strings.HasSuffix(spec, "+")
+
+	n, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+	if err != nil || n < 0 {
+		return "", errIMAPSyntax
+	}
+	if n > s.literalLeft {
+		return "", errIMAPTooLong
+	}
+	s.literalLeft -= n
+	if line, err := s.readUntil('\n'); err != nil || strings.TrimSuffix(line, "\r") != "" {
+		return "", errIMAPSyntax
+	}
+
+	if sync {
+		s.printf("+ Ready for literal data")
+		if err = s.w.Flush(); err != nil {
+			return "", err
+		}
+	}
+
+	b := make([]byte, n)
+	if _, err = io.ReadFull(s.r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// readUntil reads the command line up to and including delim, and returns
+// what precedes delim.
+func (s *imapSession) readUntil(delim byte) (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == delim {
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (s *imapSession) readAtom() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '\r' || c == '\n':
+			s.unreadByte()
+
+			return b.String(), nil
+		case depth == 0 && (c == ' ' || c == '(' || c == ')'):
+			s.unreadByte()
+
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadCommandBounds(t *testing.T) {
+	long := strings.Repeat("x", imapMaxLiteral/2+1)
+
+	tests := []struct {
+		name string
+		in   string
+		args []interface{}
+		err  error
+	}{
+		{"atoms", "a1 NOOP\r\n", []interface{}{"a1", "NOOP"}, nil},
+		{"bare LF", "a1 NOOP\n", []interface{}{"a1", "NOOP"}, nil},
+		{"list", "a1 FETCH 1 (UID BODY[HEADER.FIELDS (FROM)]<0.10>)\r\n",
+			[]interface{}{"a1", "FETCH", "1", []interface{}{"UID", "BODY[HEADER.FIELDS (FROM)]<0.10>"}}, nil},
+		{"literals", "a1 LOGIN {3+}\r\nbob {4}\r\npass\r\n", []interface{}{"a1", "LOGIN", "bob", "pass"}, nil},
+		{"literal longer than a line", "a1 X {70000+}\r\n" + strings.Repeat("y", 70000) + "\r\n",
+			[]interface{}{"a1", "X", strings.Repeat("y", 70000)}, nil},
+		{"literal at the limit", "a1 X {" + strconv.Itoa(imapMaxLiteral) + "+}\r\n" + strings.Repeat("y", imapMaxLiteral) + "\r\n",
+			[]interface{}{"a1", "X", strings.Repeat("y", imapMaxLiteral)}, nil},
+		{"literal over the limit", "a1 X {" + strconv.Itoa(imapMaxLiteral+1) + "+}\r\n", nil, errIMAPTooLong},
+		{"literals over the limit together",
+			"a1 X {" + strconv.Itoa(len(long)) + "+}\r\n" + long + " {" + strconv.Itoa(len(long)) + "+}\r\n" + long + "\r\n",
+			nil, errIMAPTooLong},
+		{"negative literal", "a1 X {-1}\r\n", nil, errIMAPSyntax},
+		{"literal without a size", "a1 X {+}\r\n", nil, errIMAPSyntax},
+		{"text after the literal size", "a1 X {3} \r\nabc\r\n", nil, errIMAPSyntax},
+		{"line at the limit", "a1 " + strings.Repeat("x", imapMaxLine-5) + "\r\n",
+			[]interface{}{"a1", strings.Repeat("x", imapMaxLine-5)}, nil},
+		{"line over the limit", "a1 " + strings.Repeat("x", imapMaxLine) + "\r\n", nil, errIMAPTooLong},
+		{"quoted string over the limit", "a1 \"" + strings.Repeat("x", imapMaxLine) + "\"\r\n", nil, errIMAPTooLong},
+		{"unclosed list", "a1 FETCH (UID\r\n", nil, errIMAPSyntax},
+		{"unopened list", "a1 FETCH UID)\r\n", nil, errIMAPSyntax},
+		{"line break in a quoted string", "a1 \"x\r\n", nil, errIMAPSyntax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &imapSession{
+				r: bufio.NewReader(strings.NewReader(tt.in)),
+				w: bufio.NewWriter(ioutil.Discard),
+			}
+
+			args, err := s.readCommand()
+			if err != tt.err {
+				t.Fatalf("got error %v; want %v", err, tt.err)
+			}
+			if err == nil && !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("got %q; want %q", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestReadCommandResumesAfterSyntaxError(t *testing.T) {
+	for _, bad := range []string{
+		"a1 FETCH (UID\r\n",
+		"a1 FETCH (UID\n",
+		"a1 FETCH UID)\r\n",
+		"a1 \"x\r\n",
+		"a1 \"x\n",
+		"a1 X {-1}\r\n",
+	} {
+		s := &imapSession{
+			r: bufio.NewReader(strings.NewReader(bad + "a2 NOOP\r\n")),
+			w: bufio.NewWriter(ioutil.Discard),
+		}
+
+		if _, err := s.readCommand(); err != errIMAPSyntax {
+			t.Fatalf("%q: got error %v; want %v", bad, err, errIMAPSyntax)
+		}
+		args, err := s.readCommand()
+		if err != nil {
+			t.Fatalf("%q: next command: %v", bad, err)
+		}
+		if want := []interface{}{"a2", "NOOP"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("%q: next command was %q; want %q", bad, args, want)
+		}
+	}
+}
+
+func TestFetchSectionPartial(t *testing.T) {
+	data := []byte("Subject: x\r\n\r\nhello world")
+	header, body := splitMessage(data)
+
+	tests := []struct {
+		item string
+		want string
+		err  error
+	}{
+		{"BODY[]", "BODY[] {25}\r\nSubject: x\r\n\r\nhello world", nil},
+		{"BODY[]<0.7>", "BODY[]<0> {7}\r\nSubject", nil},
+		{"BODY.PEEK[HEADER]<0.7>", "BODY[HEADER]<0> {7}\r\nSubject", nil},
+		{"BODY[TEXT]<6.5>", "BODY[TEXT]<6> {5}\r\nworld", nil},
+		{"BODY[TEXT]<6.1000>", "BODY[TEXT]<6> {5}\r\nworld", nil},
+		{"BODY[TEXT]<11.5>", "BODY[TEXT]<11> {0}\r\n", nil},
+		{"BODY[TEXT]<1000.5>", "BODY[TEXT]<11> {0}\r\n", nil},
+		{"BODY[TEXT]<0.0>", "BODY[TEXT]<0> {0}\r\n", nil},
+		{"BODY[TEXT]<-1.5>", "", errIMAPSyntax},
+		{"BODY[TEXT]<0.-1>", "", errIMAPSyntax},
+		{"BODY[TEXT]<x.5>", "", errIMAPSyntax},
+		{"BODY[TEXT]<5>", "", errIMAPSyntax},
+		{"BODY[TEXT", "", errIMAPSyntax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.item, func(t *testing.T) {
+			var w bytes.Buffer
+			err := fetchSection(&w, tt.item, header, body, data)
+			if err != tt.err {
+				t.Fatalf("got error %v; want %v", err, tt.err)
+			}
+			if err == nil && w.String() != tt.want {
+				t.Errorf("got %q; want %q", w.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		header, body string
+	}{
+		{"CRLF", "A: 1\r\nB: 2\r\n\r\nbody\r\n", "A: 1\r\nB: 2\r\n\r\n", "body\r\n"},
+		{"bare LF", "A: 1\nB: 2\n\nbody\n", "A: 1\nB: 2\n\n", "body\n"},
+		{"bare LF header, CRLF body", "A: 1\n\nbody\r\n\r\nmore\r\n", "A: 1\n\n", "body\r\n\r\nmore\r\n"},
+		{"mixed line ends", "A: 1\r\nB: 2\n\r\nbody", "A: 1\r\nB: 2\n\r\n", "body"},
+		{"folded header", "A: 1\r\n 2\r\n\r\nbody", "A: 1\r\n 2\r\n\r\n", "body"},
+		{"empty header", "\r\nbody", "\r\n", "body"},
+		{"empty body", "A: 1\r\n\r\n", "A: 1\r\n\r\n", ""},
+		{"no blank line", "A: 1\r\n", "A: 1\r\n", ""},
+		{"no line end", "A: 1", "A: 1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, body := splitMessage([]byte(tt.data))
+			if string(header) != tt.header || string(body) != tt.body {
+				t.Errorf("got %q, %q; want %q, %q", header, body, tt.header, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commandLatency records the time between receiving a command and
+// replying to it, for the commands in timedCommands.
+var commandLatency = newHistogramVec("smtpdump_command_latency_seconds",
+	"Time between receiving a command and sending its reply.", "command", defBuckets)
+
+// timedCommands are the commands whose latency is measured.
+var timedCommands = map[string]bool{"MAIL": true, "RCPT": true, "DATA": true}
+
+// latency summarizes the latencies of one command on a connection.
+type latency struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+// timeCommand starts timing the command verb, if it's timed.
+func (c *conn) timeCommand(verb string) {
+	c.timing = ""
+	if timedCommands[verb] {
+		c.timing, c.timingStart = verb, time.Now()
+	}
+}
+
+// observeReply records the latency of the command being timed, if any,
+// as its reply is sent.
+func (c *conn) observeReply() {
+	if c.timing == "" {
+		return
+	}
+
+	d := time.Since(c.timingStart)
+	commandLatency.observe(c.timing, d.Seconds())
+
+	if c.latencies == nil {
+		c.latencies = make(map[string]*latency)
+	}
+	l, ok := c.latencies[c.timing]
+	if !ok {
+		l = new(latency)
+		c.latencies[c.timing] = l
+	}
+	l.count++
+	l.total += d
+	if d > l.max {
+		l.max = d
+	}
+
+	c.timing = ""
+}
+
+// logLatencies logs the connection's command latencies.
+func (c *conn) logLatencies() {
+	if len(c.latencies) == 0 {
+		return
+	}
+
+	verbs := make([]string, 0, len(c.latencies))
+	for verb := range c.latencies {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	stats := make([]string, len(verbs))
+	for i, verb := range verbs {
+		l := c.latencies[verb]
+		stats[i] = fmt.Sprintf("%s n=%d avg=%s max=%s", verb, l.count,
+			(l.total / time.Duration(l.count)).Round(time.Microsecond), l.max.Round(time.Microsecond))
+	}
+
+	log.Printf("[CONN] %s command latency: %s\n", c.RemoteAddr(), strings.Join(stats, "; "))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// listenerSpec is the configuration of one listener given with the
+// -listener flag.  Unset fields fall back to the corresponding flags.
+type listenerSpec struct {
+	addr           string
+	banner         string // application name shown in the greeting
+	requireAuth    bool
+	requireTLS     bool
+	maxCommands    int    // -1 if unset
+	rcptValidation string // "" if unset
+	trustedCIDR    string // "" if unset
+}
+
+func (l listenerSpec) String() string {
+	return "addr=" + l.addr
+}
+
+// listenerSpecs is a flag.Value collecting a listenerSpec each time the
+// flag is given, in the form
+// "addr=HOST:PORT;banner=NAME;require-auth=BOOL;require-tls=BOOL;max-commands=N;rcpt-validation=LEVEL;trusted-cidr=LIST".
+// Only addr is required.
+type listenerSpecs []listenerSpec
+
+func (ls *listenerSpecs) String() string {
+	s := make([]string, len(*ls))
+	for i, l := range *ls {
+		s[i] = l.String()
+	}
+
+	return strings.Join(s, " ")
+}
+
+func (ls *listenerSpecs) Set(s string) error {
+	l := listenerSpec{maxCommands: -1}
+	for _, field := range strings.Split(s, ";") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("listener setting %q isn't key=value", field)
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		var err error
+		switch k {
+		case "addr":
+			l.addr = v
+		case "banner":
+			l.banner = v
+		case "require-auth":
+			l.requireAuth, err = strconv.ParseBool(v)
+		case "require-tls":
+			l.requireTLS, err = strconv.ParseBool(v)
+		case "max-commands":
+			l.maxCommands, err = strconv.Atoi(v)
+		case "rcpt-validation":
+			if !rcptValidations[v] {
+				err = fmt.Errorf("unknown rcpt-validation %q", v)
+			}
+			l.rcptValidation = v
+		case "trusted-cidr":
+			_, err = parseCIDRs(v)
+			l.trustedCIDR = v
+		default:
+			err = fmt.Errorf("unknown listener setting %q", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.addr == "" {
+		return fmt.Errorf("listener %q has no addr", s)
+	}
+	*ls = append(*ls, l)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// message is a received message along with its envelope.  It's built once
+// per delivery and shared by every sink, so sinks must treat it as
+// read-only.
+type message struct {
+	id       string // unique to this delivery
+	received time.Time
+	origin   net.Addr
+	from     string
+	to       []string
+	data     []byte
+	original []byte // data as received, if transforms changed it
+
+	header  mail.Header // nil if data isn't a parsable message
+	subject string
+}
+
+// newMessage returns a message for the delivery, parsing its header.
+func newMessage(origin net.Addr, from string, to []string, data []byte) (*message, error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	msg := &message{
+		id:       hex.EncodeToString(id),
+		received: time.Now(),
+		origin:   origin,
+		from:     from,
+		to:       to,
+		data:     data,
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return msg, err
+	}
+	msg.header = m.Header
+	msg.subject = m.Header.Get("Subject")
+
+	return msg, nil
+}
+
+// transform rewrites a message's content before it's delivered to sinks.
+// apply returns the new content of msg.
+type transform struct {
+	name  string
+	apply func(msg *message) ([]byte, error)
+}
+
+// transformSteps builds each transform -transforms can apply.
+var transformSteps = map[string]func() (transform, error){
+	"redact": func() (transform, error) {
+		if len(redacts) == 0 {
+			return transform{}, errors.New("the redact transform needs at least one -redact pattern")
+		}
+
+		return redactor(redacts, *redactAtt), nil
+	},
+	"normalize": func() (transform, error) {
+		return normalizer(), nil
+	},
+	"label": func() (transform, error) {
+		if *label == "" {
+			return transform{}, errors.New("the label transform needs -label")
+		}
+
+		return labelTransform(*label), nil
+	},
+	"alpn": func() (transform, error) {
+		if len(parseALPN(*alpn).selects) == 0 {
+			return transform{}, errors.New("the alpn transform needs -alpn to select a protocol")
+		}
+
+		return transform{name: "alpn", apply: alpnTransform}, nil
+	},
+	"ja3": func() (transform, error) {
+		if *capHello != "annotate" {
+			return transform{}, errors.New("the ja3 transform needs -capture-clienthello annotate")
+		}
+
+		return transform{name: "ja3", apply: clientHelloTransform}, nil
+	},
+}
+
+// parseTransforms returns the transforms named in the comma-separated
+// list, to be applied in the order listed.
+func parseTransforms(list string) ([]transform, error) {
+	var transforms []transform
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		build, ok := transformSteps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		t, err := build()
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, t)
+	}
+
+	return transforms, nil
+}
+
+// sinkDuration records how long each sink takes to deliver a message.
+var sinkDuration = newHistogramVec("smtpdump_sink_duration_seconds",
+	"Time taken by a sink to deliver a message.", "sink", defBuckets)
+
+// sink stores or forwards received messages.
+type sink struct {
+	name    string
+	deliver func(msg *message) error
+	enabled func() bool // if set, messages are delivered only while it reports true
+}
+
+// messageHandler is called when a new message is received by the server.
+// It builds the message, applies each transform in turn, and delivers the
+// result to each sink in turn.  If a transform fails, the message isn't
+// delivered.  With no sinks, messages are discarded.
+func messageHandler(transforms []transform, sinks []sink, verbose bool) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		msg, err := newMessage(origin, from, to, data)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if verbose {
+			log.Printf("Received mail %s from %q with subject %q%s\n", msg.id, from, msg.subject, connMeta(origin))
+		}
+
+		for _, t := range transforms {
+			out, err := t.apply(msg)
+			if err != nil {
+				log.Printf("[%s] %s: %v; not delivered\n", t.name, msg.id, err)
+
+				return
+			}
+			if msg.original == nil {
+				msg.original = msg.data
+			}
+			msg.data = out
+		}
+
+		for _, s := range sinks {
+			if s.enabled != nil && !s.enabled() {
+				continue
+			}
+
+			start := time.Now()
+			err := s.deliver(msg)
+			d := time.Since(start)
+			sinkDuration.observe(s.name, d.Seconds())
+
+			if err != nil {
+				log.Printf("[%s] %s: %v\n", s.name, msg.id, err)
+			}
+			if verbose {
+				log.Printf("[%s] %s delivered in %s\n", s.name, msg.id, d)
+			}
+		}
+	}
+}
+
+// copyHandler passes next a copy of each message's content.  The smtpd
+// server reuses its buffer for the session's next message, while handlers
+// and sinks may still be holding the content.
+func copyHandler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		next(origin, from, to, append([]byte(nil), data...))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// defBuckets are the default histogram buckets, in seconds.
+var defBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is written in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry holds the metrics served by -metrics-addr.
+var registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// metricsHandler serves all registered metrics.
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, m := range registry.metrics {
+		m.write(w)
+	}
+}
+
+// gauge is a value that can go up and down.
+type gauge struct {
+	v    int64 // accessed atomically; keep first for alignment
+	name string
+	help string
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	register(g)
+
+	return g
+}
+
+func (g *gauge) add(delta int64) { atomic.AddInt64(&g.v, delta) }
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.name, g.help, g.name, g.name, atomic.LoadInt64(&g.v))
+}
+
+// counter is a value that only goes up.
+type counter struct {
+	v    uint64 // accessed atomically; keep first for alignment
+	name string
+	help string
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	register(c)
+
+	return c
+}
+
+func (c *counter) inc() uint64 { return atomic.AddUint64(&c.v, 1) }
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, c.help, c.name, c.name, atomic.LoadUint64(&c.v))
+}
+
+// histogramVec is a family of histograms partitioned by one label.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	register(h)
+
+	return h
+}
+
+// observe records v in the histogram for the label value lv.
+func (h *histogramVec) observe(lv string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[lv]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[lv] = s
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	lvs := make([]string, 0, len(h.series))
+	for lv := range h.series {
+		lvs = append(lvs, lv)
+	}
+	sort.Strings(lvs)
+
+	for _, lv := range lvs {
+		s := h.series[lv]
+		label := fmt.Sprintf("%s=%s", h.label, strconv.Quote(lv))
+
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, label, formatFloat(b), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
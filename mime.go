@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+var errNoHeaderEnd = errors.New("no blank line ending the header")
+
+// part is a leaf MIME part of a message.
+type part struct {
+	header    textproto.MIMEHeader
+	mediaType string
+	params    map[string]string
+	filename  string
+	encoding  string // Content-Transfer-Encoding, lowercased
+	raw       []byte // encoded content
+	body      []byte // decoded content
+	size      int    // encoded size
+}
+
+// attachment reports whether the part is an attachment rather than
+// inline text.
+func (p *part) attachment() bool {
+	disp, _, _ := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+
+	return disp == "attachment" || p.filename != "" || !strings.HasPrefix(p.mediaType, "text/")
+}
+
+// walkParts calls fn for each leaf part of the entity with header h and
+// body r, depth-first in the order the parts appear.
+func walkParts(h textproto.MIMEHeader, r io.Reader, fn func(*part) error) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = walkParts(p.Header, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return fn(newPart(h, mediaType, params, raw))
+}
+
+func newPart(h textproto.MIMEHeader, mediaType string, params map[string]string, raw []byte) *part {
+	p := &part{
+		header:    h,
+		mediaType: mediaType,
+		params:    params,
+		encoding:  strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))),
+		raw:       raw,
+		size:      len(raw),
+	}
+	if _, dp, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		p.filename = dp["filename"]
+	}
+	if p.filename == "" {
+		p.filename = params["name"]
+	}
+
+	var err error
+	p.body, err = decodeBody(p.encoding, raw)
+	if err != nil {
+		p.body = raw
+	}
+
+	return p
+}
+
+// rewriteBody writes the body of the entity with header h and body r to
+// w, calling fn for each leaf part.  If fn reports that it changed the
+// part's decoded body or encoding, the part is re-encoded and its
+// Content-Transfer-Encoding header updated; otherwise the part is copied
+// verbatim.  The parts within a multipart body keep their header bytes,
+// delimiters, preamble and epilogue as received, except that a part whose
+// Content-Transfer-Encoding changed has its header rewritten in sorted
+// order.  Changes to the entity's own header are made to h, which the
+// caller is responsible for writing.
+func rewriteBody(w *bytes.Buffer, h textproto.MIMEHeader, r io.Reader, fn func(*part) bool) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if boundary := params["boundary"]; strings.HasPrefix(mediaType, "multipart/") && boundary != "" {
+		raw, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		delims, parts := splitMultipart(raw, boundary)
+		if len(delims) == 0 {
+			return fmt.Errorf("no %q boundary in multipart body", boundary)
+		}
+
+		w.Write(delims[0])
+		for i, p := range parts {
+			end := headerEnd(p)
+			if end == -1 {
+				return errNoHeaderEnd
+			}
+			ph, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(p[:end]))).ReadMIMEHeader()
+			if err != nil {
+				return err
+			}
+			enc := ph.Get("Content-Transfer-Encoding")
+
+			var body bytes.Buffer
+			if err = rewriteBody(&body, ph, bytes.NewReader(p[end:]), fn); err != nil {
+				return err
+			}
+			if ph.Get("Content-Transfer-Encoding") == enc {
+				w.Write(p[:end])
+			} else {
+				writeMIMEHeader(w, ph)
+			}
+			w.Write(body.Bytes())
+			w.Write(delims[i+1])
+		}
+
+		return nil
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	p := newPart(h, mediaType, params, raw)
+	if !fn(p) {
+		w.Write(raw)
+
+		return nil
+	}
+
+	if p.encoding == "" {
+		h.Del("Content-Transfer-Encoding")
+	} else {
+		h.Set("Content-Transfer-Encoding", p.encoding)
+	}
+
+	return encodeBody(w, p.encoding, p.body)
+}
+
+// splitMultipart splits body, a multipart body with boundary, into the
+// parts and the text between them: delims[0] is the preamble and first
+// delimiter line, delims[i+1] follows parts[i], and the last holds the
+// close delimiter and epilogue, if any.  Joined in order they make up
+// body.  Each delimiter starts with the line break preceding it, which
+// belongs to the delimiter rather than the part.
+func splitMultipart(body []byte, boundary string) (delims, parts [][]byte) {
+	dash := []byte("--" + boundary)
+
+	var starts, ends []int // of each delimiter
+	for i := 0; i < len(body); {
+		j := bytes.Index(body[i:], dash)
+		if j == -1 {
+			break
+		}
+		start := i + j
+		i = start + len(dash)
+		if start > 0 && body[start-1] != '\n' {
+			continue
+		}
+
+		closing := bytes.HasPrefix(body[i:], []byte("--"))
+		end := len(body)
+		if nl := bytes.IndexByte(body[i:], '\n'); nl != -1 {
+			end = i + nl + 1
+		}
+		rest := body[i:end]
+		if closing {
+			rest = rest[2:]
+		}
+		if len(bytes.TrimSpace(rest)) > 0 {
+			continue // a line merely starting with the boundary
+		}
+
+		if start > 0 {
+			start--
+			if start > 0 && body[start-1] == '\r' {
+				start--
+			}
+		}
+		if len(starts) == 0 {
+			start = 0 // the preamble goes with the first delimiter
+		}
+		starts, ends = append(starts, start), append(ends, end)
+		if closing {
+			ends[len(ends)-1] = len(body)
+
+			break
+		}
+		i = end
+	}
+
+	for k := range starts {
+		if k > 0 {
+			parts = append(parts, body[ends[k-1]:starts[k]])
+		}
+		delims = append(delims, body[starts[k]:ends[k]])
+	}
+	if n := len(ends); n > 0 && ends[n-1] < len(body) {
+		// No close delimiter: the last part runs to the end of the body.
+		parts = append(parts, body[ends[n-1]:])
+		delims = append(delims, nil)
+	}
+
+	return delims, parts
+}
+
+// encodeBody writes body to w in the Content-Transfer-Encoding enc.
+func encodeBody(w *bytes.Buffer, enc string, body []byte) error {
+	switch enc {
+	case "base64":
+		b := base64.StdEncoding.EncodeToString(body)
+		for len(b) > 76 {
+			w.WriteString(b[:76] + "\r\n")
+			b = b[76:]
+		}
+		if b != "" {
+			w.WriteString(b + "\r\n")
+		}
+
+		return nil
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(body); err != nil {
+			return err
+		}
+
+		return qw.Close()
+	}
+
+	_, err := w.Write(body)
+
+	return err
+}
+
+// writeMIMEHeader writes h to w in sorted order, followed by a blank line.
+func writeMIMEHeader(w *bytes.Buffer, h textproto.MIMEHeader) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := k
+		if s, ok := headerSpellings[k]; ok {
+			name = s
+		}
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", name, v)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// headerEnd returns the offset in data just past the blank line ending
+// its header, which may end in CRLF or a bare LF, or -1 if there's none.
+func headerEnd(data []byte) int {
+	for i := 0; i < len(data); {
+		j := bytes.IndexByte(data[i:], '\n')
+		if j == -1 {
+			break
+		}
+		if line := data[i : i+j]; len(line) == 0 || bytes.Equal(line, []byte("\r")) {
+			return i + j + 1
+		}
+		i += j + 1
+	}
+
+	return -1
+}
+
+// decodeBody decodes raw according to the Content-Transfer-Encoding enc.
+func decodeBody(enc string, raw []byte) ([]byte, error) {
+	switch enc {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	}
+
+	return raw, nil
+}
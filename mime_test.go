@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitMultipart(t *testing.T) {
+	tests := []struct {
+		name     string
+		boundary string
+		body     string
+		delims   []string
+		parts    []string
+	}{
+		{
+			name:   "CRLF",
+			body:   "preamble\r\n--b\r\nA: 1\r\n\r\none\r\n--b\r\n\r\ntwo\r\n--b--\r\nepilogue\r\n",
+			delims: []string{"preamble\r\n--b\r\n", "\r\n--b\r\n", "\r\n--b--\r\nepilogue\r\n"},
+			parts:  []string{"A: 1\r\n\r\none", "\r\ntwo"},
+		},
+		{
+			name:   "bare LF",
+			body:   "--b\nA: 1\n\none\n--b\n\ntwo\n--b--\n",
+			delims: []string{"--b\n", "\n--b\n", "\n--b--\n"},
+			parts:  []string{"A: 1\n\none", "\ntwo"},
+		},
+		{
+			name:   "transport padding",
+			body:   "--b \t\r\n\r\none\r\n--b-- \r\n",
+			delims: []string{"--b \t\r\n", "\r\n--b-- \r\n"},
+			parts:  []string{"\r\none"},
+		},
+		{
+			name:     "nested",
+			boundary: "o",
+			body:     "--o\r\nContent-Type: multipart/mixed; boundary=i\r\n\r\n--i\r\n\r\ninner\r\n--i--\r\n--o--\r\n",
+			delims:   []string{"--o\r\n", "\r\n--o--\r\n"},
+			parts:    []string{"Content-Type: multipart/mixed; boundary=i\r\n\r\n--i\r\n\r\ninner\r\n--i--"},
+		},
+		{
+			name:   "nested boundary extending the outer one",
+			body:   "--b\r\nContent-Type: multipart/mixed; boundary=bb\r\n\r\n--bb\r\n\r\ninner\r\n--bb--\r\n--b--\r\n",
+			delims: []string{"--b\r\n", "\r\n--b--\r\n"},
+			parts:  []string{"Content-Type: multipart/mixed; boundary=bb\r\n\r\n--bb\r\n\r\ninner\r\n--bb--"},
+		},
+		{
+			name:   "boundary within a line",
+			body:   "--b\r\n\r\nsee --b\r\n--b--",
+			delims: []string{"--b\r\n", "\r\n--b--"},
+			parts:  []string{"\r\nsee --b"},
+		},
+		{
+			name:   "no close delimiter",
+			body:   "--b\r\n\r\none\r\n--b\r\n\r\ntwo\r\n",
+			delims: []string{"--b\r\n", "\r\n--b\r\n", ""},
+			parts:  []string{"\r\none", "\r\ntwo\r\n"},
+		},
+		{
+			name: "no delimiter",
+			body: "just text\r\n",
+		},
+		{
+			name: "empty",
+			body: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boundary := tt.boundary
+			if boundary == "" {
+				boundary = "b"
+			}
+			delims, parts := splitMultipart([]byte(tt.body), boundary)
+			if got := strs(delims); !reflect.DeepEqual(got, tt.delims) {
+				t.Errorf("got delimiters %q; want %q", got, tt.delims)
+			}
+			if got := strs(parts); !reflect.DeepEqual(got, tt.parts) {
+				t.Errorf("got parts %q; want %q", got, tt.parts)
+			}
+
+			if len(delims) == 0 {
+				return // not multipart; nothing to put back together
+			}
+			var joined bytes.Buffer
+			for i, d := range delims {
+				joined.Write(d)
+				if i < len(parts) {
+					joined.Write(parts[i])
+				}
+			}
+			if joined.String() != tt.body {
+				t.Errorf("joined %q; want %q", joined.String(), tt.body)
+			}
+		})
+	}
+}
+
+func strs(bs [][]byte) []string {
+	var s []string
+	for _, b := range bs {
+		s = append(s, string(b))
+	}
+
+	return s
+}
+
+// nestedMessage returns a message whose text part is nested depth
+// multiparts deep, with boundaries varying in length and line ends.
+func nestedMessage(depth int, eol string) string {
+	entity := "Content-Type: text/plain" + eol + eol + "secret"
+	for d := depth; d > 0; d-- {
+		b := fmt.Sprintf("b%d", d)
+		entity = fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s%s%s--%s%s%s%s--%s--%s",
+			b, eol, eol, b, eol, entity, eol, b, eol)
+	}
+
+	return "Subject: nested" + eol + entity
+}
+
+func TestRewriteBodyNested(t *testing.T) {
+	for _, tt := range []struct {
+		depth int
+		eol   string
+	}{
+		{1, "\r\n"},
+		{2, "\n"},
+		{10, "\r\n"},
+		{500, "\r\n"},
+		{500, "\n"},
+	} {
+		t.Run(fmt.Sprintf("%d%q", tt.depth, tt.eol), func(t *testing.T) {
+			data := nestedMessage(tt.depth, tt.eol)
+
+			for _, redact := range []bool{false, true} {
+				msg, err := mail.ReadMessage(strings.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body := data[headerEnd([]byte(data)):]
+
+				var leaves int
+				var w bytes.Buffer
+				err = rewriteBody(&w, textproto.MIMEHeader(msg.Header), msg.Body, func(p *part) bool {
+					leaves++
+					if !redact {
+						return false
+					}
+					p.body = bytes.Replace(p.body, []byte("secret"), redactPlaceholder, -1)
+
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if leaves != 1 {
+					t.Errorf("visited %d leaf parts; want 1", leaves)
+				}
+
+				want := body
+				if redact {
+					want = strings.Replace(body, "secret", string(redactPlaceholder), 1)
+				}
+				if w.String() != want {
+					t.Errorf("redact=%t: body changed beyond the leaf part", redact)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// essentialHeaders are written first, in this order, by normalize.  All
+// other headers follow in sorted order.
+var essentialHeaders = []string{
+	"X-Smtpdump-Label", "Received", "Return-Path", "Date", "From", "Sender", "Reply-To",
+	"To", "Cc", "Bcc", "Message-Id", "In-Reply-To", "References", "Subject",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// headerSpellings overrides the canonical spelling of headers whose
+// conventional spelling differs.
+var headerSpellings = map[string]string{
+	"Message-Id":       "Message-ID",
+	"Mime-Version":     "MIME-Version",
+	"X-Smtpdump-Label": "X-SMTPdump-Label",
+}
+
+// normalizer returns the transform applying normalize.
+func normalizer() transform {
+	return transform{
+		name:  "normalize",
+		apply: func(m *message) ([]byte, error) { return normalize(m.data) },
+	}
+}
+
+// normalize reformats data for readability while keeping it a valid
+// message: headers are consistently cased, ordered, and unfolded then
+// refolded with normalized whitespace, and quoted-printable or base64
+// text parts are decoded to 8bit where that's safe.
+func normalize(data []byte) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	h := textproto.MIMEHeader(msg.Header)
+
+	var body bytes.Buffer
+	err = rewriteBody(&body, h, msg.Body, func(p *part) bool {
+		if !strings.HasPrefix(p.mediaType, "text/") ||
+			(p.encoding != "quoted-printable" && p.encoding != "base64") ||
+			!safe8bit(p.body) {
+			return false
+		}
+		p.body = crlf(p.body)
+		p.encoding = "8bit"
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	written := make(map[string]bool)
+	write := func(k string) {
+		name := k
+		if s, ok := headerSpellings[k]; ok {
+			name = s
+		}
+		for _, v := range h[k] {
+			writeFoldedHeader(&out, name, strings.Join(strings.Fields(v), " "))
+		}
+		written[k] = true
+	}
+
+	for _, k := range essentialHeaders {
+		write(k)
+	}
+	rest := make([]string, 0, len(h))
+	for k := range h {
+		if !written[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		write(k)
+	}
+
+	out.WriteString("\r\n")
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// writeFoldedHeader writes the header field name: value to w, folding it
+// at whitespace to keep lines within 78 characters where possible.
+func writeFoldedHeader(w *bytes.Buffer, name, value string) {
+	line, empty := name+":", true
+	for _, word := range strings.Split(value, " ") {
+		if len(line)+1+len(word) > 78 && !empty {
+			w.WriteString(line + "\r\n")
+			line = ""
+		}
+		line, empty = line+" "+word, false
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// safe8bit reports whether b can be sent with an 8bit transfer encoding:
+// it has no NULs or bare CRs and no line longer than 998 octets.
+func safe8bit(b []byte) bool {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > 998 || bytes.ContainsAny(line, "\x00\r") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// crlf converts the line endings in b to CRLF.
+func crlf(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// writeSpec writes the OpenAPI 3 description of the API, served under
+// prefix, to w as JSON.
+func (a *api) writeSpec(w io.Writer, prefix string) error {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range a.routes(prefix) {
+		resp := map[string]interface{}{"description": http.StatusText(rt.status)}
+		if rt.contentType != "" {
+			resp["content"] = map[string]interface{}{
+				rt.contentType: map[string]interface{}{"schema": map[string]string{"type": "string"}},
+			}
+		}
+
+		op := map[string]interface{}{
+			"operationId": strings.ToLower(rt.method) + operationName(rt.path),
+			"summary":     rt.summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(rt.status): resp,
+				"405":                   map[string]string{"description": "Method not allowed"},
+			},
+		}
+		var params []map[string]interface{}
+		for _, seg := range strings.Split(rt.path, "/") {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				params = append(params, map[string]interface{}{
+					"name":     strings.Trim(seg, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]string{"type": "string"},
+				})
+			}
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = make(map[string]interface{})
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+
+	server := prefix
+	if server == "" {
+		server = "/"
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "smtpdump API",
+			"version": buildVersion(),
+		},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+	})
+}
+
+// operationName returns the name of the operation on path for its
+// operationId, such as "ExportCsv" for "/export.csv".  Parameters are
+// left out.
+func operationName(path string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '.' || r == '-' }) {
+		if strings.HasPrefix(word, "{") {
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/mhale/smtpd"
+)
+
+// pauseSwitch switches message handling between capturing and
+// discarding at runtime.
+type pauseSwitch struct {
+	paused int32 // accessed atomically
+}
+
+// set pauses or resumes capturing, logging the change along with what
+// caused it.  It reports whether the state changed.
+func (p *pauseSwitch) set(paused bool, cause string) bool {
+	var old, new int32 = 1, 0
+	if paused {
+		old, new = 0, 1
+	}
+	if !atomic.CompareAndSwapInt32(&p.paused, old, new) {
+		return false
+	}
+
+	if paused {
+		log.Printf("[PAUSE] Capturing paused by %s; discarding messages\n", cause)
+	} else {
+		log.Printf("[PAUSE] Capturing resumed by %s\n", cause)
+	}
+
+	return true
+}
+
+// toggle flips between capturing and discarding.
+func (p *pauseSwitch) toggle(cause string) {
+	if !p.set(true, cause) {
+		p.set(false, cause)
+	}
+}
+
+// watch toggles capturing on every signal received from sig.
+func (p *pauseSwitch) watch(sig <-chan os.Signal) {
+	for s := range sig {
+		p.toggle(s.String())
+	}
+}
+
+// handler returns a Handler that passes messages to capturing, or to
+// discarding while paused.
+func (p *pauseSwitch) handler(capturing, discarding smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		if atomic.LoadInt32(&p.paused) == 1 {
+			discarding(origin, from, to, data)
+
+			return
+		}
+
+		capturing(origin, from, to, data)
+	}
+}
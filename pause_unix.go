@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause relays the signal toggling capturing, SIGUSR2, to c.
+func notifyPause(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyPause does nothing, as Windows has no SIGUSR2.  Capturing can
+// still be paused through the API.
+func notifyPause(chan<- os.Signal) {}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	putAttempts = 3
+	putBackoff  = time.Second
+	putTimeout  = 30 * time.Second
+)
+
+// putSink PUTs each message to a URL built from a template, replacing
+// {filename} with the message's file name.
+type putSink struct {
+	url    string
+	auth   string   // "user:password" for basic auth, or an Authorization value
+	naming string   // "counter" or "hash" for deterministic names
+	hash   hashAlgo // for "hash" naming
+	ext    string
+	client *http.Client
+
+	counter uint64 // accessed atomically
+}
+
+func newPutSink(tmpl, auth, naming string, h hashAlgo, ext string) (*putSink, error) {
+	if !strings.Contains(tmpl, "{filename}") {
+		return nil, errors.New("-http-put-url must contain {filename}")
+	}
+	if _, err := url.Parse(strings.Replace(tmpl, "{filename}", "x", -1)); err != nil {
+		return nil, err
+	}
+
+	return &putSink{
+		url:    tmpl,
+		auth:   auth,
+		naming: naming,
+		hash:   h,
+		ext:    ext,
+		client: &http.Client{Timeout: putTimeout},
+	}, nil
+}
+
+// sink returns a sink that PUTs messages to the target.
+func (p *putSink) sink() sink {
+	return sink{name: "http-put", deliver: p.deliver}
+}
+
+// deliver PUTs msg, retrying with backoff after network errors and
+// responses indicating a transient failure.
+func (p *putSink) deliver(msg *message) error {
+	name := deterministicName(p.naming, p.hash, &p.counter, p.ext, msg)
+	if name == "" {
+		name = fmt.Sprintf("%d_%s.%s", msg.received.UnixNano(), msg.id, p.ext)
+	}
+	target := strings.Replace(p.url, "{filename}", url.PathEscape(name), -1)
+
+	var err error
+	backoff := putBackoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = p.put(target, msg.data); err == nil || !retry || attempt == putAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// put makes one PUT request, reporting whether a failure is worth
+// retrying.
+func (p *putSink) put(target string, data []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+
+	switch user := strings.SplitN(p.auth, ":", 2); {
+	case p.auth == "":
+	case len(user) == 2 && !strings.Contains(user[0], " "):
+		req.SetBasicAuth(user[0], user[1])
+	default:
+		req.Header.Set("Authorization", p.auth)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("PUT %s: %s", target, resp.Status)
+}
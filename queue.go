@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/mhale/smtpd"
+)
+
+// messagesInFlight counts the messages accepted but not yet handled.
+var messagesInFlight = newGauge("smtpdump_messages_in_flight", "Number of accepted messages being handled.")
+
+// messageQueue tracks the messages the smtpd server has accepted and
+// handed to the Handler, each in its own goroutine, but which haven't
+// yet been handled.
+type messageQueue struct {
+	n     int64 // accessed atomically; keep first for alignment
+	limit int64
+}
+
+// full reports whether the queue holds its limit of messages, and how
+// many it holds.
+func (q *messageQueue) full() (bool, int64) {
+	n := atomic.LoadInt64(&q.n)
+
+	return n >= q.limit, n
+}
+
+// handler returns a Handler counting the messages passed to next while
+// they're handled.
+func (q *messageQueue) handler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		atomic.AddInt64(&q.n, 1)
+		messagesInFlight.add(1)
+		defer func() {
+			atomic.AddInt64(&q.n, -1)
+			messagesInFlight.add(-1)
+		}()
+
+		next(origin, from, to, data)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// rateMonitor samples the rate at which messages are received and raises
+// an alarm when it stays outside the expected band for a sustained
+// period.
+type rateMonitor struct {
+	received uint64 // accessed atomically; keep first for alignment
+	alarmed  int32  // accessed atomically
+
+	expect    float64       // expected messages per second
+	tolerance float64       // accepted deviation as a fraction of expect
+	window    time.Duration // sampling window
+	sustain   time.Duration // how long the rate must deviate to alarm
+}
+
+// handler counts each message before passing it to next.
+func (m *rateMonitor) handler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		atomic.AddUint64(&m.received, 1)
+		next(origin, from, to, data)
+	}
+}
+
+// failed reports whether the monitor raised an alarm at any point.
+func (m *rateMonitor) failed() bool {
+	return atomic.LoadInt32(&m.alarmed) != 0
+}
+
+// run samples the received rate every window until done is closed.
+// Sampling starts with the first message so idle time before the sender
+// starts isn't held against it.
+func (m *rateMonitor) run(done <-chan struct{}) {
+	t := time.NewTicker(m.window)
+	defer t.Stop()
+
+	var (
+		last       uint64
+		deviating  time.Time
+		inAlarm    bool
+		low, high  = m.expect * (1 - m.tolerance), m.expect * (1 + m.tolerance)
+		windowSecs = m.window.Seconds()
+	)
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			n := atomic.LoadUint64(&m.received)
+			if n == 0 {
+				continue
+			}
+			rate := float64(n-last) / windowSecs
+			last = n
+
+			if rate >= low && rate <= high {
+				if inAlarm {
+					log.Printf("[RATE] Recovered: %.2f msg/s within %.2f-%.2f msg/s\n", rate, low, high)
+				}
+				deviating, inAlarm = time.Time{}, false
+
+				continue
+			}
+
+			if deviating.IsZero() {
+				deviating = now
+			}
+			if !inAlarm && now.Sub(deviating) >= m.sustain {
+				inAlarm = true
+				atomic.StoreInt32(&m.alarmed, 1)
+				log.Printf("[RATE] Alarm: %.2f msg/s outside %.2f-%.2f msg/s for %s\n",
+					rate, low, high, now.Sub(deviating).Round(time.Millisecond))
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// duplicateModes are the supported -duplicate-rcpt modes.
+var duplicateModes = map[string]bool{"accept": true, "dedup": true, "reject": true}
+
+// rcptValidations are the supported -rcpt-validation levels.
+var rcptValidations = map[string]bool{"none": true, "syntax": true, "mx": true}
+
+// rcptPolicy decides whether the server accepts a recipient.
+type rcptPolicy struct {
+	hostname   string
+	maxDomains int           // maximum distinct recipient domains per transaction
+	window     *acceptWindow // accept recipients only within this window
+	validation string        // "syntax" or "mx" to validate recipients
+	queue      *messageQueue // defer recipients while this is full
+	duplicates string        // "dedup" or "reject" duplicate recipients
+	authRcpts  int           // maximum recipients per authenticated transaction
+	anonRcpts  int           // maximum recipients per anonymous transaction
+	dnsTimeout time.Duration // bounds the MX lookup of "mx" validation
+	allow      *allowlist    // if set, accept only senders it permits
+}
+
+// handler is the smtpd.HandlerRcpt for the policy.  It logs every
+// recipient and records those it accepts in the connection's current
+// transaction.
+func (p *rcptPolicy) handler(origin net.Addr, from string, to string) bool {
+	log.Printf("[RCPT] %q => %q%s\n", from, to, connMeta(origin))
+
+	c := lookupConn(origin)
+	if c == nil {
+		return true
+	}
+
+	if p.queue != nil {
+		if full, n := p.queue.full(); full {
+			log.Printf("[RCPT] Deferred %q: %d messages in flight; applying backpressure\n", to, n)
+			c.rcptReply(fmt.Sprintf("451 4.3.1 %s Too many messages queued, try again later", p.hostname))
+
+			return false
+		}
+	}
+
+	if c.hasRcpt(to) {
+		log.Printf("[RCPT] Duplicate %q in transaction from %s\n", to, origin)
+
+		switch p.duplicates {
+		case "dedup":
+			return true
+		case "reject":
+			c.rcptReply(fmt.Sprintf("554 5.5.1 %s Duplicate recipient %s", p.hostname, to))
+
+			return false
+		}
+	}
+
+	if c.trusted {
+		c.addRcpt(to)
+
+		return true
+	}
+
+	if p.window != nil && !p.window.contains(time.Now()) {
+		log.Printf("[RCPT] Deferred %q: outside accept window %s\n", to, p.window.spec)
+		c.rcptReply(fmt.Sprintf("451 4.3.2 %s Not accepting mail outside %s, try again later",
+			p.hostname, p.window.spec))
+
+		return false
+	}
+
+	if p.allow != nil {
+		switch ok, loaded := p.allow.permits(addrIP(origin), from); {
+		case !loaded:
+			log.Printf("[RCPT] Deferred %q: allowlist not loaded yet\n", to)
+			c.rcptReply(fmt.Sprintf("451 4.3.0 %s Sender policy unavailable, try again later", p.hostname))
+
+			return false
+		case !ok:
+			log.Printf("[RCPT] Refused %q: sender %q from %s isn't allowlisted\n", to, from, origin)
+			c.rcptReply(fmt.Sprintf("550 5.7.1 %s Sender not permitted", p.hostname))
+
+			return false
+		}
+	}
+
+	if reply := p.validate(to); reply != "" {
+		c.rcptReply(reply)
+
+		return false
+	}
+
+	if p.maxDomains > 0 {
+		if n := c.rcptDomains(to); n > p.maxDomains {
+			log.Printf("[RCPT] Refused %q: %d distinct recipient domains exceeds %d\n",
+				to, n, p.maxDomains)
+			c.rcptReply(fmt.Sprintf("452 4.5.3 %s Too many recipient domains", p.hostname))
+
+			return false
+		}
+	}
+
+	limit, session := p.anonRcpts, "anonymous"
+	if c.authenticated() {
+		limit, session = p.authRcpts, "authenticated"
+	}
+	if limit > 0 && c.rcptCount() >= limit {
+		log.Printf("[RCPT] Refused %q: %s transaction already has %d recipients\n", to, session, limit)
+		c.rcptReply(fmt.Sprintf("452 4.5.3 %s Too many recipients", p.hostname))
+
+		return false
+	}
+
+	c.addRcpt(to)
+
+	return true
+}
+
+// validate checks to according to the policy's validation level.  It
+// returns the reply refusing the recipient, if any.
+func (p *rcptPolicy) validate(to string) string {
+	if p.validation != "syntax" && p.validation != "mx" {
+		return ""
+	}
+
+	if _, err := mail.ParseAddress(to); err != nil || !strings.Contains(to, "@") {
+		log.Printf("[RCPT] Refused %q: malformed address\n", to)
+
+		return fmt.Sprintf("553 5.1.3 %s Malformed recipient address", p.hostname)
+	}
+
+	if p.validation != "mx" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.dnsTimeout)
+	defer cancel()
+
+	domain := rcptDomain(to)
+	mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(mxs) > 0:
+		return ""
+	case err == nil, errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		log.Printf("[RCPT] Refused %q: domain %q has no MX record\n", to, domain)
+
+		return fmt.Sprintf("550 5.1.2 %s Recipient domain %s has no MX record", p.hostname, domain)
+	default:
+		log.Printf("[RCPT] Deferred %q: MX lookup of %q failed: %v\n", to, domain, err)
+
+		return fmt.Sprintf("451 4.4.3 %s Unable to look up recipient domain %s, try again later",
+			p.hostname, domain)
+	}
+}
+
+// dedupHandler passes each message to next with duplicate recipients
+// removed from its envelope.  The smtpd server records every accepted
+// RCPT, so recipients accepted as duplicates are dropped here.
+func dedupHandler(next smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		unique := make([]string, 0, len(to))
+	next:
+		for _, rcpt := range to {
+			for _, u := range unique {
+				if sameAddr(u, rcpt) {
+					continue next
+				}
+			}
+			unique = append(unique, rcpt)
+		}
+
+		next(origin, from, unique, data)
+	}
+}
+
+// sameAddr reports whether a and b are the same address, comparing their
+// domains case-insensitively.
+func sameAddr(a, b string) bool {
+	i, j := strings.LastIndexByte(a, '@'), strings.LastIndexByte(b, '@')
+
+	return a[:i+1] == b[:j+1] && strings.EqualFold(a[i+1:], b[j+1:])
+}
+
+// rcptDomain returns the lowercased domain of addr.
+func rcptDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// redactPlaceholder replaces each match of a -redact pattern.
+var redactPlaceholder = []byte("[REDACTED]")
+
+// patterns is a flag.Value collecting a regular expression each time the
+// flag is given.
+type patterns []*regexp.Regexp
+
+func (p *patterns) String() string {
+	s := make([]string, len(*p))
+	for i, re := range *p {
+		s[i] = re.String()
+	}
+
+	return strings.Join(s, " ")
+}
+
+func (p *patterns) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, re)
+
+	return nil
+}
+
+// redactor returns a transform replacing matches of res in the decoded
+// text parts of a message, and in attachments too if attachments is set.
+// Changed parts are re-encoded with their original transfer encoding, so
+// the headers of the message and of each of its parts are kept verbatim.
+func redactor(res []*regexp.Regexp, attachments bool) transform {
+	return transform{
+		name: "redact",
+		apply: func(m *message) ([]byte, error) {
+			data := m.data
+			msg, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+
+			var body bytes.Buffer
+			changed := false
+			err = rewriteBody(&body, textproto.MIMEHeader(msg.Header), msg.Body, func(p *part) bool {
+				if p.attachment() && !attachments {
+					return false
+				}
+
+				redacted := p.body
+				for _, re := range res {
+					redacted = re.ReplaceAll(redacted, redactPlaceholder)
+				}
+				if bytes.Equal(redacted, p.body) {
+					return false
+				}
+				p.body, changed = redacted, true
+
+				return true
+			})
+			if err != nil || !changed {
+				return data, err
+			}
+
+			end := headerEnd(data)
+			if end == -1 {
+				return nil, errNoHeaderEnd
+			}
+
+			return append(data[:end:end], body.Bytes()...), nil
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRedactFoldedHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "folded subject",
+			data: "Subject: the secret\r\n\tSubject: secret\r\n\r\na secret\r\n",
+			want: "Subject: the secret\r\n\tSubject: secret\r\n\r\na [REDACTED]\r\n",
+		},
+		{
+			name: "bare LF fold",
+			data: "Subject: the secret\n secret\n\na secret\n",
+			want: "Subject: the secret\n secret\n\na [REDACTED]\n",
+		},
+		{
+			name: "boundary on a fold line",
+			data: "Content-Type: multipart/mixed;\r\n\tboundary=\"b\"\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain;\r\n charset=utf-8\r\n\r\na secret\r\n--b--\r\n",
+			want: "Content-Type: multipart/mixed;\r\n\tboundary=\"b\"\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain;\r\n charset=utf-8\r\n\r\na [REDACTED]\r\n--b--\r\n",
+		},
+		{
+			name: "bare LF boundary on a fold line",
+			data: "Content-Type: multipart/mixed;\n boundary=b\n\n--b\n\na secret\n--b--\n",
+			want: "Content-Type: multipart/mixed;\n boundary=b\n\n--b\n\na [REDACTED]\n--b--\n",
+		},
+		{
+			name: "folded part encoding",
+			data: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Transfer-Encoding:\r\n quoted-printable\r\n\r\na sec=\r\nret\r\n--b--\r\n",
+			want: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Transfer-Encoding:\r\n quoted-printable\r\n\r\na [REDACTED]\r\n--b--\r\n",
+		},
+		{
+			name: "folded attachment disposition",
+			data: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Disposition: attachment;\r\n filename=a.txt\r\n\r\na secret\r\n--b--\r\n",
+			want: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Disposition: attachment;\r\n filename=a.txt\r\n\r\na secret\r\n--b--\r\n",
+		},
+	}
+
+	redact := redactor([]*regexp.Regexp{regexp.MustCompile("secret")}, false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redact.apply(&message{data: []byte(tt.data)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
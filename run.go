@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildVersion returns the module version smtpdump was built from.
+func buildVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+
+	return "(devel)"
+}
+
+// secretFlags are summarized with their values redacted, since they hold
+// credentials.
+var secretFlags = map[string]bool{"http-put-auth": true}
+
+// urlFlags are summarized with the userinfo and query of their URLs
+// redacted, since either may hold credentials.
+var urlFlags = map[string]bool{"http-put-url": true, "allowlist-url": true, "conn-webhook": true}
+
+// redactFlag returns the value of the flag for the run summary.
+func redactFlag(f *flag.Flag) string {
+	v := f.Value.String()
+	switch {
+	case secretFlags[f.Name]:
+		return "REDACTED"
+	case urlFlags[f.Name]:
+		if i := strings.IndexByte(v, '?'); i != -1 {
+			v = v[:i] + "?REDACTED"
+		}
+		if i := strings.Index(v, "://"); i != -1 {
+			host := v[i+3:]
+			if j := strings.IndexAny(host, "/?"); j != -1 {
+				host = host[:j]
+			}
+			if j := strings.LastIndexByte(host, '@'); j != -1 {
+				v = v[:i+3] + "REDACTED" + v[i+3+j:]
+			}
+		}
+	}
+
+	return v
+}
+
+// runSummary describes a run of the server for the start and end of run
+// events.
+type runSummary struct {
+	version  string
+	hostname string
+	addr     string
+	config   string // flags set on the command line, sorted by name
+	started  time.Time
+}
+
+func newRunSummary(hostname, addr string) *runSummary {
+	r := &runSummary{version: buildVersion(), hostname: hostname, addr: addr, started: time.Now()}
+
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		set = append(set, fmt.Sprintf("-%s=%q", f.Name, redactFlag(f)))
+	})
+	sort.Strings(set)
+	r.config = strings.Join(set, " ")
+
+	return r
+}
+
+// start logs the start of run event.
+func (r *runSummary) start() {
+	log.Printf("[RUN] Start: smtpdump %s on %s listening on %q with %s\n",
+		r.version, r.hostname, r.addr, r.configOrDefaults())
+}
+
+// end logs the end of run event.
+func (r *runSummary) end() {
+	log.Printf("[RUN] End: smtpdump %s on %s listening on %q after %s\n",
+		r.version, r.hostname, r.addr, time.Since(r.started).Round(time.Second))
+}
+
+func (r *runSummary) configOrDefaults() string {
+	if r.config == "" {
+		return "default flags"
+	}
+
+	return r.config
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tmpSuffix is appended to the names of files being written with
+// -receipt=rename.
+const tmpSuffix = ".tmp"
+
+// openFiles counts the files open for writing by file stores.
+var openFiles = newGauge("smtpdump_open_files", "Number of message files open for writing.")
+
+// fileStore writes each message to a new file in a directory.  If
+// saveOriginal is set and the message was transformed, the message as
+// received is also written to the same name with ".orig" appended.
+type fileStore struct {
+	dir          string
+	ext          string
+	naming       string   // "counter" or "hash" for deterministic names
+	hash         hashAlgo // for "hash" naming
+	saveOriginal bool     // also write transformed messages as received
+	armor        string   // if set, the -armor encoding of stored files
+	verbose      bool
+	gc           *gitCommitter // if set, saved files are queued for commit
+	slots        fileSlots     // if set, limits the files open at once
+	receipt      string        // "done" or "rename" to mark complete files
+	byMessageID  bool          // name files for their Message-ID where possible
+
+	counter uint64 // accessed atomically
+}
+
+// sink returns a sink that delivers messages to the store.
+func (fs *fileStore) sink() sink {
+	return sink{name: "file", deliver: fs.deliver}
+}
+
+func (fs *fileStore) deliver(msg *message) error {
+	defer fs.slots.acquire()()
+
+	f, err := fs.create(msg)
+	if err != nil {
+		return err
+	}
+	openFiles.add(1)
+	_, err = f.Write(fs.encode(msg.data))
+	if err == nil && fs.receipt != "" {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	openFiles.add(-1)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(f.Name(), tmpSuffix)
+
+	if fs.saveOriginal && msg.original != nil {
+		orig := name + ".orig"
+		openFiles.add(1)
+		err = ioutil.WriteFile(orig, fs.encode(msg.original), 0600)
+		openFiles.add(-1)
+		if err != nil {
+			return err
+		}
+
+		if fs.verbose {
+			log.Printf("Wrote %q\n", orig)
+		}
+
+		if fs.gc != nil {
+			fs.gc.add(orig, msg.from, msg.subject)
+		}
+	}
+
+	switch fs.receipt {
+	case "rename":
+		// Link rather than rename, so an existing file isn't replaced.  If
+		// linking fails, the message is left in its temporary file.
+		if err = os.Link(f.Name(), name); err != nil {
+			if os.IsExist(err) {
+				return fmt.Errorf("%q already exists; message left in %q", name, f.Name())
+			}
+
+			return err
+		}
+		if err = os.Remove(f.Name()); err != nil {
+			return err
+		}
+	case "done":
+		if err = ioutil.WriteFile(name+".done", nil, 0600); err != nil {
+			return err
+		}
+	}
+
+	if fs.verbose {
+		log.Printf("Wrote %q\n", name)
+	}
+
+	if fs.gc != nil {
+		fs.gc.add(name, msg.from, msg.subject)
+	}
+
+	return nil
+}
+
+// fileSlots bounds the files open for writing at once, for
+// -max-open-files.  It's shared by every writer of message, mbox and
+// prelude files.  Transcripts are open for the life of their connection,
+// so they aren't counted.
+type fileSlots chan struct{}
+
+// acquire waits for a free slot if s is set and returns the function
+// releasing it.  A writer holds one slot, as it writes its files one at
+// a time.
+func (s fileSlots) acquire() func() {
+	if s == nil {
+		return func() {}
+	}
+
+	s <- struct{}{}
+
+	return func() { <-s }
+}
+
+// encode returns data as it's stored in the store's files.
+func (fs *fileStore) encode(data []byte) []byte {
+	if fs.armor == "" {
+		return data
+	}
+
+	return armor(fs.armor, data)
+}
+
+// create returns a new file for msg, named for its Message-ID if the
+// store names files that way and the name is free.  Deterministic names are derived
+// only from the order of arrival or the content, so identical runs
+// produce identical names.  A deterministic name that's already taken is
+// an error rather than a reason to pick another.  With -receipt=rename,
+// the file's name has tmpSuffix appended.
+func (fs *fileStore) create(msg *message) (*os.File, error) {
+	var suffix string
+	if fs.receipt == "rename" {
+		suffix = tmpSuffix
+	}
+
+	if fs.byMessageID {
+		if f, err := fs.createByMessageID(msg, suffix); f != nil || err != nil {
+			return f, err
+		}
+	}
+
+	name := deterministicName(fs.naming, fs.hash, &fs.counter, fs.ext, msg)
+	if name == "" {
+		return randFile(fs.dir, fmt.Sprintf("%d", time.Now().UnixNano()), fs.ext+suffix)
+	}
+
+	name = filepath.Join(fs.dir, name+suffix)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("deterministic file name %q already exists", name)
+	}
+
+	return f, err
+}
+
+// createByMessageID returns a new file for msg named for its Message-ID,
+// with suffix appended.  It returns a nil file and error if msg has no
+// Message-ID or a message with the same one was already stored, so the
+// store's usual naming applies.
+func (fs *fileStore) createByMessageID(msg *message, suffix string) (*os.File, error) {
+	id := messageIDName(msg)
+	if id == "" {
+		return nil, nil
+	}
+
+	name := filepath.Join(fs.dir, id+"."+fs.ext)
+	if _, err := os.Stat(name); err == nil {
+		if fs.verbose {
+			log.Printf("Message-ID file name %q already exists\n", name)
+		}
+
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(name+suffix, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, nil
+	}
+
+	return f, err
+}
+
+// messageIDName returns msg's Message-ID without its angle brackets and
+// with characters unsafe in file names replaced, or "" if it has none.
+func messageIDName(msg *message) string {
+	if msg.header == nil {
+		return ""
+	}
+
+	id := strings.TrimSpace(msg.header.Get("Message-Id"))
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	id = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			strings.ContainsRune("@._+-=", r):
+			return r
+		}
+
+		return '_'
+	}, id)
+	id = strings.TrimLeft(id, ".")
+	if len(id) > 200 {
+		id = id[:200]
+	}
+
+	return id
+}
+
+// deterministicName returns the name for msg under the -deterministic
+// naming scheme, or "" if names are random.  Counter names take the next
+// value of counter.
+func deterministicName(naming string, h hashAlgo, counter *uint64, ext string, msg *message) string {
+	switch naming {
+	case "counter":
+		return fmt.Sprintf("%08d.%s", atomic.AddUint64(counter, 1), ext)
+	case "hash":
+		return fmt.Sprintf("%s.%s", h.sum(withoutReceived(msg.data)), ext)
+	}
+
+	return ""
+}
+
+// withoutReceived returns data without its first Received header, which
+// the smtpd server adds with the time of receipt.
+func withoutReceived(data []byte) []byte {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		end = len(data)
+	}
+
+	for i := 0; i < end; {
+		next := bytes.Index(data[i:end], []byte("\r\n"))
+		if next == -1 {
+			break
+		}
+		next += i + 2
+
+		if !bytes.HasPrefix(bytes.ToLower(data[i:next]), []byte("received:")) {
+			i = next
+
+			continue
+		}
+
+		// Include the header's continuation lines.
+		for next < end && (data[next] == ' ' || data[next] == '\t') {
+			n := bytes.Index(data[next:end], []byte("\r\n"))
+			if n == -1 {
+				next = end
+
+				break
+			}
+			next += n + 2
+		}
+
+		out := make([]byte, 0, len(data)-(next-i))
+
+		return append(append(out, data[:i]...), data[next:]...)
+	}
+
+	return data
+}
+
+// stdoutSink returns a sink that writes each message to w, framed so a
+// downstream reader can reliably split the stream.  Every message is
+// preceded by a line of the form "SMTPDUMP <length>\n" and followed by a
+// single "\n".  The length is the number of message bytes between the two.
+func stdoutSink(w io.Writer) sink {
+	var mu sync.Mutex
+
+	return sink{
+		name: "stdout",
+		deliver: func(msg *message) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			_, err := fmt.Fprintf(w, "SMTPDUMP %d\n%s\n", len(msg.data), msg.data)
+
+			return err
+		},
+	}
+}
+
+// sampleSink returns a sink passing the first first messages, then each
+// further message with probability rate, to s.  The rest are discarded.
+func sampleSink(s sink, first uint64, rate float64) sink {
+	var (
+		mu    sync.Mutex
+		count uint64
+		rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	)
+
+	return sink{
+		name: "sample",
+		deliver: func(msg *message) error {
+			mu.Lock()
+			count++
+			keep := count <= first || rnd.Float64() < rate
+			mu.Unlock()
+
+			if !keep {
+				return nil
+			}
+
+			return s.deliver(msg)
+		},
+	}
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/mail"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
@@ -19,22 +20,104 @@ import (
 )
 
 var (
+	accWindow = flag.String("accept-window", "", "accept recipients only between HH:MM-HH:MM, deferring others")
 	addr      = flag.String("addr", "127.0.0.1:2525", "Listen address:port")
+	apiSpec   = flag.Bool("api-spec", false, "write the OpenAPI description of the HTTP API to stdout and exit")
+	armorMode = flag.String("armor", "", "store messages encoded as base64 or pem (default raw)")
+	alpn      = flag.String("alpn", "", "comma-separated ALPN protocols to select; prefix with ! to refuse")
+	anonRcpts = flag.Int("anon-max-rcpts", 0, "maximum recipients per transaction of unauthenticated sessions (0 = unlimited)")
+	anonSize  = flag.Int("anon-max-size", 0, "maximum message bytes from unauthenticated sessions (0 = unlimited)")
+	allowURL  = flag.String("allowlist-url", "", "accept only sender IPs, networks and domains listed at this URL")
+	allowRef  = flag.Duration("allowlist-refresh", 5*time.Minute, "interval between -allowlist-url fetches")
+	apiAddr   = flag.String("api-addr", "", "HTTP API listen address:port (default disabled)")
+	authRcpts = flag.Int("auth-max-rcpts", 0, "maximum recipients per transaction of authenticated sessions (0 = unlimited)")
+	authSize  = flag.Int("auth-max-size", 0, "maximum message bytes from authenticated sessions (0 = unlimited)")
 	cert      = flag.String("cert", "", "PEM-encoded certificate")
+	captureIf = flag.String("capture-if", "", "store only messages with a header matching Name=value or Name~=regexp")
+	capHello  = flag.String("capture-clienthello", "", "fingerprint each TLS ClientHello with JA3: log, or annotate stored messages")
+	prelude   = flag.Bool("capture-prelude", false, "save the plaintext conversation preceding STARTTLS to the output directory")
+	dataDelay = flag.Duration("data-prompt-delay", 0, "delay before sending the 354 DATA prompt")
+	collAddr  = flag.String("collector-addr", "", "ship raw messages to this collector address:port")
+	collBuf   = flag.Int("collector-buffer", 1000, "messages buffered while the collector is unreachable")
+	collTLS   = flag.Bool("collector-tls", false, "connect to the collector using TLS")
 	colorize  = flag.Bool("color", true, "colorize debug output")
+	connHook  = flag.String("conn-webhook", "", "POST a JSON event to this URL when each connection opens and closes")
+	connRate  = flag.Int("conn-webhook-rate", 10, "maximum -conn-webhook events per second, dropping the rest")
+	determin  = flag.String("deterministic", "", "name files by arrival \"counter\" or content \"hash\" (default random)")
+	dropRate  = flag.Float64("drop-rate", 0, "fraction of connections dropped abruptly after the greeting, mid-RCPT or mid-DATA")
+	dropSeed  = flag.Int64("drop-seed", 0, "seed choosing the -drop-rate drops, for reproducible runs (0 = random)")
 	discard   = flag.Bool("discard", false, "discard incoming messages")
+	sampleDir = flag.String("discard-sample-dir", "", "with -discard, save a sample of messages to this directory")
+	sampleN   = flag.Uint64("discard-sample-first", 10, "number of messages saved first by -discard-sample-dir")
+	sampleP   = flag.Float64("discard-sample-rate", 0, "fraction of later messages saved by -discard-sample-dir")
+	dnsAddr   = flag.String("dns-resolver", "", "send all DNS lookups to this resolver address[:port] (default system resolvers)")
+	dnsWait   = flag.Duration("dns-timeout", 5*time.Second, "timeout of each DNS lookup")
+	dupRcpt   = flag.String("duplicate-rcpt", "accept", "handle duplicate recipients in a transaction: accept, dedup or reject")
+	enfSize   = flag.String("enforce-size", "", "check messages against the declared SIZE: reject or annotate")
+	etrnMode  = flag.String("etrn", "", "answer ETRN with accept, deny or queued (default unsupported)")
+	execTypes = flag.String("executable-types", defaultExecutableTypes, "comma-separated attachment extensions and media types refused by -reject-executables")
+	expRate   = flag.Float64("expect-rate", 0, "expected messages per second (0 = don't monitor)")
 	extension = flag.String("extension", "eml", "Saved file extension")
+	greetWait = flag.Duration("greeting-delay", 0, "delay before sending the 220 greeting, detecting early talkers")
+	gitRepo   = flag.String("git-repo", "", "commit saved messages to this Git repository")
+	groupConn = flag.Bool("group-by-connection", false, "write the messages of each connection to one mbox file, on close")
+	gitEvery  = flag.Duration("git-interval", 10*time.Second, "interval between batched Git commits")
+	hashName  = flag.String("hash-algo", "sha256", "content hash algorithm: sha256 or sha512")
+	keepAlive = flag.Duration("keepalive", 0, "TCP keep-alive period for accepted connections (0 = default, negative disables)")
+	httpAddr  = flag.String("http-addr", "", "serve /healthz, /metrics, /api/ and /debug/pprof/ on this address:port")
+	putURL    = flag.String("http-put-url", "", "PUT each message to this URL, replacing {filename} with its file name")
+	putAuth   = flag.String("http-put-auth", "", "-http-put-url credentials as user:password, or an Authorization header value")
+	imapAddr  = flag.String("imap-addr", "", "serve stored messages read-only over IMAP on this address:port")
+	logMeta   = flag.Bool("log-conn-meta", false, "include connection ID, addresses, TLS version and age in AUTH, RCPT and received mail logs")
+	label     = flag.String("label", "", "run label stamped into stored messages and log output")
+	nameMsgID = flag.Bool("name-by-message-id", false, "name stored files for their Message-ID, falling back to the usual naming")
+	metrAddr  = flag.String("metrics-addr", "", "Prometheus metrics listen address:port (default disabled)")
+	maxSess   = flag.Duration("max-session", 0, "close connections open longer than this with a 421 (0 = unlimited)")
+	maxShakes = flag.Int("max-handshakes", 0, "maximum concurrent TLS handshakes, queuing the rest (0 = unlimited)")
+	maxAtts   = flag.Int("max-attachments", 0, "reject messages with more attachments than this (0 = unlimited)")
+	maxAttLen = flag.Int("max-attachment-size", 0, "reject messages with an attachment larger than this many decoded bytes (0 = unlimited)")
+	maxCmds   = flag.Int("max-commands", 0, "maximum SMTP commands per connection (0 = unlimited)")
+	maxDoms   = flag.Int("max-rcpt-domains", 0, "maximum distinct recipient domains per transaction (0 = unlimited)")
 	output    = flag.String("output", "", "Output directory (default to current directory)")
+	normalizd = flag.Bool("normalize", false, "reformat stored messages for readability")
 	minTLS11  = flag.Bool("tls11", false, "accept TLSv1.1 as a minimum")
 	minTLS12  = flag.Bool("tls12", false, "accept TLSv1.2 as a minimum")
 	minTLS13  = flag.Bool("tls13", false, "accept TLSv1.3 as a minimum")
 	pkey      = flag.String("key", "", "PEM-encoded private key")
+	xforms    = flag.String("transforms", "", "comma-separated transforms applied to messages in order: redact, normalize, label, alpn, ja3 (implies -save-original)")
+	transDir  = flag.String("transcript-dir", "", "record each connection's conversation, decrypted after STARTTLS, with timing, to a file in this directory")
+	trustNets = flag.String("trusted-cidr", "", "comma-separated networks exempt from filtering")
+	tz        = flag.String("tz", "Local", "time zone of -accept-window")
+	saveOrig  = flag.Bool("save-original", false, "also store messages as received when they're altered")
+	sizeTol   = flag.Float64("size-tolerance", 0.1, "accepted -enforce-size deviation as a fraction of SIZE")
+	redactAtt = flag.Bool("redact-attachments", false, "also apply -redact to attachments")
+	queueMax  = flag.Int64("queue-limit", 0, "defer recipients while this many messages are being handled (0 = unlimited)")
+	rcptValid = flag.String("rcpt-validation", "none", "validate recipients: none, syntax or mx")
+	runEvents = flag.Bool("run-events", false, "log start and end of run events with a config summary")
+	logLaten  = flag.Bool("log-command-latency", false, "log each connection's MAIL, RCPT and DATA reply latency on close")
+	maxFiles  = flag.Int("max-open-files", 0, "maximum message, mbox and prelude files open for writing at once; transcripts aren't counted (0 = unlimited)")
+	receipt   = flag.String("receipt", "", "mark complete files with a \"done\" marker file or by \"rename\" from .tmp")
+	rejExec   = flag.Bool("reject-executables", false, "reject messages with executable attachments")
+	quarant   = flag.Bool("quarantine", false, "keep messages rejected after DATA in the rejected subdirectory of -output")
+	rejEarly  = flag.Bool("reject-early-talkers", false, "reject clients that talk before the greeting")
+	rateFail  = flag.Bool("rate-fail", false, "exit non-zero at shutdown if the rate alarm was raised")
+	rateSust  = flag.Duration("rate-sustain", 30*time.Second, "how long the rate must deviate before alarming")
+	rateTol   = flag.Float64("rate-tolerance", 0.1, "accepted rate deviation as a fraction of -expect-rate")
+	rateWin   = flag.Duration("rate-window", 10*time.Second, "rate sampling window")
+	strict7   = flag.String("strict-7bit", "", "check messages for 8-bit content sent without 8BITMIME: reject or annotate")
+	stdout    = flag.Bool("stdout", false, "write framed messages to stdout instead of files")
+	unknReply = flag.String("unknown-command-response", "", "reply sent verbatim to unrecognized commands (default 500)")
 	verbose   = flag.Bool("verbose", false, "verbose output")
 
-	readPrintf  = color.New(color.FgGreen).Printf
-	writePrintf = color.New(color.FgCyan).Printf
+	readColor  = color.New(color.FgGreen)
+	writeColor = color.New(color.FgCyan)
 
-	hostname string
+	readPrintf  = readColor.Printf
+	writePrintf = writeColor.Printf
+
+	hostname  string
+	redacts   patterns
+	listeners listenerSpecs
 )
 
 func init() {
@@ -44,11 +127,32 @@ func init() {
 	}
 	flag.StringVar(&hostname, "hostname", hn, "Server host name")
 	flag.BoolVar(&smtpd.Debug, "debug", false, "debug output")
+	flag.Var(&listeners, "listener", "listen with its own settings, as \"addr=HOST:PORT;banner=NAME;...\" (repeatable; replaces -addr)")
+	flag.Var(&redacts, "redact", "redact matches of this regular expression from text parts (repeatable)")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			diffCmd(os.Args[2:])
+			return
+		case "export-csv":
+			exportCSVCmd(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
+	if *apiSpec {
+		if err := new(api).writeSpec(os.Stdout, ""); err != nil {
+			log.Fatalln(err)
+		}
+
+		return
+	}
+
 	if hostname == "" {
 		log.Fatalln("Hostname cannot be empty")
 	}
@@ -56,13 +160,40 @@ func main() {
 	if smtpd.Debug {
 		*verbose = true
 
-		if !*colorize {
+		switch {
+		case !*colorize && *stdout:
+			readPrintf = stderrPrintf
+			writePrintf = stderrPrintf
+		case !*colorize:
 			readPrintf = fmt.Printf
 			writePrintf = fmt.Printf
+		case *stdout:
+			readPrintf = func(format string, a ...interface{}) (int, error) {
+				return readColor.Fprintf(color.Error, format, a...)
+			}
+			writePrintf = func(format string, a ...interface{}) (int, error) {
+				return writeColor.Fprintf(color.Error, format, a...)
+			}
 		}
 	}
 
-	var err error
+	if strings.ContainsAny(*label, "\r\n") {
+		log.Fatalln("Label cannot contain line breaks")
+	}
+	if *label != "" {
+		log.SetPrefix(fmt.Sprintf("[%s] ", *label))
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+	}
+
+	if *armorMode != "" && !armorModes[*armorMode] {
+		log.Fatalf("Unknown -armor %q\n", *armorMode)
+	}
+
+	algo, err := parseHashAlgo(*hashName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	if *output == "" {
 		*output, err = os.Getwd()
 		if err != nil {
@@ -74,11 +205,246 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	var handler smtpd.Handler
-	if *discard {
-		handler = discardHandler(*verbose)
-	} else {
-		handler = outputHandler(*output, *extension, *verbose)
+	configureResolver(*dnsAddr, *dnsWait)
+
+	pause := new(pauseSwitch)
+	if *imapAddr != "" {
+		is := newIMAPServer(*output, *extension, *armorMode != "")
+		go func() { log.Fatalln(is.listenAndServe(*imapAddr)) }()
+	}
+
+	if *httpAddr != "" && (*apiAddr != "" || *metrAddr != "") {
+		log.Fatalln("-http-addr can't be combined with -api-addr or -metrics-addr")
+	}
+
+	toggles := newSinkToggles()
+	a := &api{
+		output: *output,
+		ext:    *extension,
+		hash:   algo,
+		armor:  *armorMode != "",
+		pause:  pause,
+		sinks:  toggles,
+	}
+	if *httpAddr != "" {
+		go func() { log.Fatalln(http.ListenAndServe(*httpAddr, httpHandler(a))) }()
+
+		if *verbose {
+			log.Printf("HTTP listening on %q ...\n", *httpAddr)
+		}
+	}
+
+	if *apiAddr != "" {
+		go func() { log.Fatalln(http.ListenAndServe(*apiAddr, a.handler(""))) }()
+
+		if *verbose {
+			log.Printf("API listening on %q ...\n", *apiAddr)
+		}
+	}
+
+	if *metrAddr != "" {
+		go func() { log.Fatalln(http.ListenAndServe(*metrAddr, http.HandlerFunc(metricsHandler))) }()
+
+		if *verbose {
+			log.Printf("Metrics listening on %q ...\n", *metrAddr)
+		}
+	}
+
+	var gc *gitCommitter
+	if *gitRepo != "" && !*discard && !*stdout {
+		gc, err = newGitCommitter(*gitRepo, *output, hostname, *gitEvery)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var (
+		sinks  []sink
+		groups *connGroups
+		slots  fileSlots
+	)
+	if *maxFiles > 0 {
+		slots = make(fileSlots, *maxFiles)
+	}
+	switch {
+	case *discard && *sampleDir != "":
+		if _, err = os.Stat(*sampleDir); err != nil {
+			log.Fatalln(err)
+		}
+		fs := &fileStore{dir: *sampleDir, ext: *extension, armor: *armorMode, verbose: *verbose, slots: slots}
+		sinks = append(sinks, sampleSink(fs.sink(), *sampleN, *sampleP))
+	case *discard:
+	case *stdout:
+		sinks = append(sinks, stdoutSink(os.Stdout))
+	case *groupConn:
+		groups = newConnGroups(*output, *verbose, gc, slots)
+		sinks = append(sinks, groups.sink())
+	default:
+		fs := &fileStore{
+			dir:          *output,
+			ext:          *extension,
+			naming:       *determin,
+			hash:         algo,
+			saveOriginal: *saveOrig || *xforms != "",
+			armor:        *armorMode,
+			verbose:      *verbose,
+			gc:           gc,
+			byMessageID:  *nameMsgID,
+			slots:        slots,
+		}
+		switch *receipt {
+		case "", "done", "rename":
+			fs.receipt = *receipt
+		default:
+			log.Fatalf("Unknown -receipt %q\n", *receipt)
+		}
+		sinks = append(sinks, fs.sink())
+	}
+
+	var coll *collector
+	if *collAddr != "" {
+		coll, err = newCollector(*collAddr, *collTLS, *collBuf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sinks = append(sinks, coll.sink())
+	}
+
+	if *putURL != "" {
+		ps, err := newPutSink(*putURL, *putAuth, *determin, algo, *extension)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sinks = append(sinks, ps.sink())
+	}
+
+	for i := range sinks {
+		sinks[i] = toggles.wrap(sinks[i])
+	}
+
+	var transforms []transform
+	switch {
+	case *xforms != "":
+		if transforms, err = parseTransforms(*xforms); err != nil {
+			log.Fatalln(err)
+		}
+		listed := make(map[string]bool)
+		for _, t := range transforms {
+			listed[t.name] = true
+		}
+		if len(redacts) > 0 && !listed["redact"] {
+			log.Fatalln("-redact is set but redact isn't listed in -transforms")
+		}
+		if *normalizd && !listed["normalize"] {
+			log.Fatalln("-normalize is set but normalize isn't listed in -transforms")
+		}
+		if *label != "" && !listed["label"] {
+			log.Fatalln("-label is set but label isn't listed in -transforms")
+		}
+		if len(parseALPN(*alpn).selects) > 0 && !listed["alpn"] {
+			log.Fatalln("-alpn selects protocols but alpn isn't listed in -transforms")
+		}
+		if *capHello == "annotate" && !listed["ja3"] {
+			log.Fatalln("-capture-clienthello is annotate but ja3 isn't listed in -transforms")
+		}
+	default:
+		if len(redacts) > 0 {
+			transforms = append(transforms, redactor(redacts, *redactAtt))
+		}
+		if *normalizd {
+			transforms = append(transforms, normalizer())
+		}
+	}
+
+	handler := messageHandler(transforms, sinks, *verbose)
+	if *captureIf != "" {
+		pred, err := parseHeaderPredicate(*captureIf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		handler = pred.handler(handler, *verbose)
+	}
+	handler = pause.handler(handler, messageHandler(nil, nil, *verbose))
+	if *label != "" && *xforms == "" {
+		handler = labelHandler(handler, *label)
+	}
+
+	var rm *rateMonitor
+	if *expRate > 0 {
+		rm = &rateMonitor{
+			expect:    *expRate,
+			tolerance: *rateTol,
+			window:    *rateWin,
+			sustain:   *rateSust,
+		}
+		handler = rm.handler(handler)
+	}
+	var quarantine smtpd.Handler
+	if *quarant {
+		dir := filepath.Join(*output, "rejected")
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			log.Fatalln(err)
+		}
+		fs := &fileStore{dir: dir, ext: *extension, armor: *armorMode, verbose: *verbose, slots: slots}
+		quarantine = messageHandler(transforms, []sink{fs.sink()}, *verbose)
+	}
+	var events *connEvents
+	if *connHook != "" {
+		if *connRate < 1 {
+			log.Fatalln("-conn-webhook-rate must be at least 1")
+		}
+		events = newConnEvents(*connHook, *connRate)
+		handler = events.handler(handler)
+	}
+	if *xforms == "" {
+		handler = alpnHandler(handler)
+	}
+	handler = verdictHandler(handler, quarantine)
+	if *capHello == "annotate" && *xforms == "" {
+		handler = clientHelloHandler(handler)
+	}
+	if *dupRcpt == "dedup" {
+		handler = dedupHandler(handler)
+	}
+
+	var queue *messageQueue
+	if *queueMax > 0 {
+		queue = &messageQueue{limit: *queueMax}
+		handler = queue.handler(handler)
+	}
+	handler = copyHandler(handler)
+
+	rcpt := &rcptPolicy{
+		hostname:   hostname,
+		maxDomains: *maxDoms,
+		validation: *rcptValid,
+		queue:      queue,
+		duplicates: *dupRcpt,
+		authRcpts:  *authRcpts,
+		anonRcpts:  *anonRcpts,
+		dnsTimeout: *dnsWait,
+	}
+	if *allowURL != "" {
+		rcpt.allow = newAllowlist(*allowURL, *allowRef)
+		if err = rcpt.allow.refresh(); err != nil {
+			log.Printf("[ALLOW] Fetching %q failed, deferring recipients: %v\n", *allowURL, err)
+		}
+	}
+	if !duplicateModes[*dupRcpt] {
+		log.Fatalf("Unknown -duplicate-rcpt %q\n", *dupRcpt)
+	}
+	if !rcptValidations[*rcptValid] {
+		log.Fatalf("Unknown -rcpt-validation %q\n", *rcptValid)
+	}
+	if *accWindow != "" {
+		loc, err := time.LoadLocation(*tz)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		rcpt.window, err = parseAcceptWindow(*accWindow, loc)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	srv := &smtpd.Server{
@@ -86,6 +452,7 @@ func main() {
 		Appname:     "SMTPDump",
 		AuthHandler: authHandler,
 		Handler:     handler,
+		Hostname:    hostname,
 		LogRead: func(_, _, line string) {
 			line = strings.Replace(line, "\n", "\n  ", -1)
 			_, _ = readPrintf("  %s\n", line)
@@ -94,7 +461,8 @@ func main() {
 			line = strings.Replace(line, "\n", "\n  ", -1)
 			_, _ = writePrintf("  %s\n", line)
 		},
-		HandlerRcpt: rcptHandler,
+		HandlerRcpt: rcpt.handler,
+		Timeout:     5 * time.Minute,
 	}
 
 	if *cert != "" && *pkey != "" {
@@ -116,74 +484,270 @@ func main() {
 			srv.TLSConfig.MinVersion = tls.VersionTLS11
 			log.Println("Minimum TLSv1.1 accepted")
 		}
-	}
 
-	if *verbose {
-		log.Printf("Listening on %q ...\n", *addr)
+		srv.TLSConfig.GetConfigForClient = parseALPN(*alpn).configForClient(srv.TLSConfig)
+		if *maxShakes > 0 {
+			h := &handshakeLimit{slots: make(chan struct{}, *maxShakes)}
+			srv.TLSConfig.GetConfigForClient = h.limit(srv.TLSConfig.GetConfigForClient)
+		}
+		srv.TLSConnWrapper = wrapTLS
 	}
 
-	log.Fatalln(srv.ListenAndServe())
-}
+	etrnReplies := map[string]string{
+		"":       "",
+		"accept": "250 OK, queuing for node %s started",
+		"deny":   "459 4.7.1 Node %s not allowed",
+		"queued": "253 OK, 0 pending messages for node %s started",
+	}
+	etrn, ok := etrnReplies[*etrnMode]
+	if !ok {
+		log.Fatalf("Unknown -etrn %q\n", *etrnMode)
+	}
 
-// authHandler logs credentials and always returns true.
-func authHandler(_ net.Addr, _ string, username []byte, password []byte, _ []byte) (bool, error) {
-	log.Printf("[AUTH] User: %q; Password: %q\n", username, password)
-	return true, nil
-}
+	switch *determin {
+	case "", "counter", "hash":
+	default:
+		log.Fatalf("Unknown -deterministic %q\n", *determin)
+	}
 
-func discardHandler(verbose bool) smtpd.Handler {
-	return func(origin net.Addr, from string, to []string, data []byte) {
-		if verbose {
-			msg, err := mail.ReadMessage(bytes.NewReader(data))
-			if err != nil {
-				log.Println(err)
+	var checks []dataCheck
+	switch *enfSize {
+	case "":
+	case "reject", "annotate":
+		checks = append(checks, sizeCheck(hostname, *sizeTol, *enfSize == "reject"))
+	default:
+		log.Fatalf("Unknown -enforce-size %q\n", *enfSize)
+	}
+	switch *strict7 {
+	case "":
+	case "reject", "annotate":
+		checks = append(checks, strict7bitCheck(hostname, *strict7 == "reject"))
+	default:
+		log.Fatalf("Unknown -strict-7bit %q\n", *strict7)
+	}
+	if *authSize > 0 || *anonSize > 0 {
+		checks = append(checks, sessionSizeCheck(hostname, *authSize, *anonSize))
+	}
+	if *maxAtts > 0 || *maxAttLen > 0 {
+		checks = append(checks, attachmentCheck(hostname, *maxAtts, *maxAttLen))
+	}
+	if *rejExec {
+		checks = append(checks, executableCheck(hostname, strings.Split(*execTypes, ",")))
+	}
 
-				return
-			}
-			subject := msg.Header.Get("Subject")
+	trusted, err := parseCIDRs(*trustNets)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-			log.Printf("Received mail from %q with subject %q\n", from, subject)
+	if *transDir != "" {
+		if _, err = os.Stat(*transDir); err != nil {
+			log.Fatalln(err)
 		}
 	}
-}
+	if len(redacts) > 0 && (*transDir != "" || *prelude) {
+		log.Fatalln("-redact can't be combined with -transcript-dir or -capture-prelude, which record messages unredacted")
+	}
 
-// outputHandler is called when a new message is received by the server.
-func outputHandler(output, ext string, verbose bool) smtpd.Handler {
-	return func(origin net.Addr, from string, to []string, data []byte) {
-		if verbose {
-			msg, err := mail.ReadMessage(bytes.NewReader(data))
-			if err != nil {
-				log.Println(err)
+	var preludeDir string
+	if *prelude {
+		preludeDir = *output
+	}
 
-				return
-			}
-			subject := msg.Header.Get("Subject")
+	cfg := &connConfig{
+		hostname:           hostname,
+		maxCommands:        *maxCmds,
+		dataPromptDelay:    *dataDelay,
+		greetingDelay:      *greetWait,
+		rejectEarlyTalkers: *rejEarly,
+		preludeDir:         preludeDir,
+		files:              slots,
+		unknownReply:       *unknReply,
+		trusted:            trusted,
+		etrn:               etrn,
+		dataChecks:         checks,
+		logLatency:         *logLaten,
+		logMeta:            *logMeta,
+		transcriptDir:      *transDir,
+		captureHello:       *capHello != "",
+		annotateHello:      *capHello == "annotate",
+		maxSession:         *maxSess,
+		events:             events,
+	}
+	if *dropRate > 0 {
+		seed := *dropSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		cfg.drops = newConnDrops(*dropRate, seed)
+		log.Printf("[DROP] Dropping %g of connections with -drop-seed %d\n", *dropRate, seed)
+	}
+	if *capHello != "" && !clientHelloModes[*capHello] {
+		log.Fatalf("Unknown -capture-clienthello %q\n", *capHello)
+	}
+	if groups != nil {
+		cfg.onClose = groups.closed
+	}
+
+	specs := listeners
+	if len(specs) == 0 {
+		specs = listenerSpecs{{addr: *addr, maxCommands: -1}}
+	}
 
-			log.Printf("Received mail from %q with subject %q\n", from, subject)
+	var (
+		servers []*smtpd.Server
+		lns     []net.Listener
+		addrs   []string
+	)
+	lc := net.ListenConfig{KeepAlive: *keepAlive}
+	for _, spec := range specs {
+		if spec.requireTLS && srv.TLSConfig == nil {
+			log.Fatalf("Listener %q has require-tls but TLS isn't enabled; set -cert and -key\n", spec.addr)
 		}
+		s, l := configureListener(srv, cfg, rcpt, spec)
 
-		f, err := randFile(output, fmt.Sprintf("%d", time.Now().UnixNano()), ext)
+		ln, err := lc.Listen(context.Background(), "tcp", spec.addr)
 		if err != nil {
-			log.Println(err)
+			log.Fatalln(err)
+		}
+		l.Listener = ln
 
-			return
+		if *verbose {
+			log.Printf("Listening on %q ...\n", spec.addr)
 		}
-		defer func() { _ = f.Close() }()
 
-		_, err = io.Copy(f, bytes.NewReader(data))
-		if err != nil {
-			log.Println(err)
+		servers = append(servers, s)
+		lns = append(lns, l)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	var run *runSummary
+	if *runEvents {
+		run = newRunSummary(hostname, strings.Join(addrs, ", "))
+		run.start()
+	}
+
+	closing := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(closing)
+		for _, ln := range lns {
+			_ = ln.Close()
 		}
+	}()
+
+	usr := make(chan os.Signal, 1)
+	notifyPause(usr)
+	go pause.watch(usr)
+
+	if rm != nil {
+		go rm.run(closing)
+	}
+	if rcpt.allow != nil {
+		go rcpt.allow.run(closing)
+	}
 
-		if verbose {
-			log.Printf("Wrote %q\n", f.Name())
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(s *smtpd.Server, ln net.Listener) { errs <- s.Serve(ln) }(servers[i], lns[i])
+	}
+	for range servers {
+		err = <-errs
+		select {
+		case <-closing:
+		default:
+			log.Fatalln(err)
 		}
 	}
+
+	if *verbose {
+		log.Println("Shutting down ...")
+	}
+
+	if gc != nil {
+		gc.Close()
+	}
+	if groups != nil {
+		groups.Close()
+	}
+	if coll != nil {
+		coll.Close()
+	}
+	if run != nil {
+		run.end()
+	}
+
+	if rm != nil && rm.failed() && *rateFail {
+		log.Fatalln("Message rate alarm was raised")
+	}
 }
 
-func rcptHandler(_ net.Addr, from string, to string) bool {
-	log.Printf("[RCPT] %q => %q\n", from, to)
-	return true
+// configureListener returns the server and listener for spec, derived
+// from the shared srv, cfg and rcpt with the spec's settings applied.
+// The caller sets the returned listener's underlying net.Listener.
+func configureListener(srv *smtpd.Server, cfg *connConfig, rcpt *rcptPolicy,
+	spec listenerSpec) (*smtpd.Server, *listener) {
+	s, c, r := *srv, *cfg, *rcpt
+
+	s.Addr = spec.addr
+	if spec.banner != "" {
+		s.Appname = spec.banner
+	}
+	s.AuthRequired = spec.requireAuth
+	s.TLSRequired = spec.requireTLS
+
+	if spec.maxCommands >= 0 {
+		c.maxCommands = spec.maxCommands
+	}
+	if spec.trustedCIDR != "" {
+		c.trusted, _ = parseCIDRs(spec.trustedCIDR) // validated by Set
+	}
+	if spec.rcptValidation != "" {
+		r.validation = spec.rcptValidation
+	}
+	s.HandlerRcpt = r.handler
+
+	return &s, &listener{cfg: &c}
+}
+
+// authHandler logs credentials and always returns true, marking the
+// connection as authenticated.
+func authHandler(origin net.Addr, _ string, username []byte, password []byte, _ []byte) (bool, error) {
+	log.Printf("[AUTH] User: %q; Password: %q%s\n", username, password, connMeta(origin))
+	if c := lookupConn(origin); c != nil {
+		c.setAuthenticated()
+	}
+	return true, nil
+}
+
+// stderrPrintf is a fmt.Printf that writes to standard error.
+func stderrPrintf(format string, a ...interface{}) (int, error) {
+	return fmt.Fprintf(os.Stderr, format, a...)
+}
+
+// labelHandler prepends an X-SMTPdump-Label header carrying label to each
+// message before passing it to next.
+func labelHandler(next smtpd.Handler, label string) smtpd.Handler {
+	header := []byte(fmt.Sprintf("X-SMTPdump-Label: %s\r\n", label))
+
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		next(origin, from, to, append(header[:len(header):len(header)], data...))
+	}
+}
+
+// labelTransform returns the label transform, prepending the header
+// labelHandler would to each message.
+func labelTransform(label string) transform {
+	header := []byte(fmt.Sprintf("X-SMTPdump-Label: %s\r\n", label))
+
+	return transform{
+		name: "label",
+		apply: func(msg *message) ([]byte, error) {
+			return append(header[:len(header):len(header)], msg.data...), nil
+		},
+	}
 }
 
 // randFile returns a pointer to a new file or an error.  If
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// sinkToggles enables and disables sinks by name at runtime.
+type sinkToggles struct {
+	mu       sync.Mutex
+	disabled map[string]*int32 // accessed atomically
+}
+
+// newSinkToggles returns toggles with no sinks.
+func newSinkToggles() *sinkToggles {
+	return &sinkToggles{disabled: make(map[string]*int32)}
+}
+
+// wrap returns s, enabled only while it isn't disabled.  Sinks wrapped
+// under the same name are toggled together.
+func (t *sinkToggles) wrap(s sink) sink {
+	t.mu.Lock()
+	off, ok := t.disabled[s.name]
+	if !ok {
+		off = new(int32)
+		t.disabled[s.name] = off
+	}
+	t.mu.Unlock()
+
+	enabled := s.enabled
+	s.enabled = func() bool {
+		return atomic.LoadInt32(off) == 0 && (enabled == nil || enabled())
+	}
+
+	return s
+}
+
+// set enables or disables the sink name, logging the change along with
+// what caused it.  It reports whether the sink exists.
+func (t *sinkToggles) set(name string, enabled bool, cause string) bool {
+	t.mu.Lock()
+	off, ok := t.disabled[name]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	var old, new int32 = 1, 0
+	if !enabled {
+		old, new = 0, 1
+	}
+	if !atomic.CompareAndSwapInt32(off, old, new) {
+		return true
+	}
+
+	if enabled {
+		log.Printf("[SINK] %q enabled by %s\n", name, cause)
+	} else {
+		log.Printf("[SINK] %q disabled by %s; skipping its deliveries\n", name, cause)
+	}
+
+	return true
+}
+
+// states returns whether each sink is enabled, by name.
+func (t *sinkToggles) states() map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	states := make(map[string]bool, len(t.disabled))
+	for name, off := range t.disabled {
+		states[name] = atomic.LoadInt32(off) == 0
+	}
+
+	return states
+}
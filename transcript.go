@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcript records the SMTP conversation on a connection to a file, one
+// read or write per line, decrypted after STARTTLS.  Each line holds the seconds since
+// the connection was accepted, C for bytes from the client or S for bytes
+// from the server, and the bytes as a Go quoted string, so the session
+// can be replayed with its timing.  Lines starting with # are comments.
+type transcript struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+// newTranscript creates the transcript of c, accepted at start, in dir.
+func newTranscript(dir string, c net.Conn, start time.Time) (*transcript, error) {
+	remote := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(c.RemoteAddr().String())
+	name := filepath.Join(dir, fmt.Sprintf("%d_%s.transcript", start.UnixNano(), remote))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transcript{f: f, w: bufio.NewWriter(f), start: start}
+	t.note("smtpdump transcript local=%s remote=%s accepted=%s",
+		c.LocalAddr(), c.RemoteAddr(), start.Format(time.RFC3339Nano))
+
+	return t, nil
+}
+
+// record records b, sent by the client if from is 'C' or the server if
+// from is 'S'.
+func (t *transcript) record(from byte, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "%.6f %c %q\n", time.Since(t.start).Seconds(), from, b)
+}
+
+// note records a comment.
+func (t *transcript) note(format string, a ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "# %.6f "+format+"\n", append([]interface{}{time.Since(t.start).Seconds()}, a...)...)
+}
+
+// Close writes out and closes the transcript.
+func (t *transcript) Close() error {
+	t.note("closed")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.w.Flush()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/mhale/smtpd"
+)
+
+// dataCheck inspects the content of a transaction before the server
+// acknowledges it.  It returns a reply rejecting the message, or header
+// lines to prepend to it, or neither to accept it unchanged.
+type dataCheck func(c *conn, txn *transaction, body []byte) (reply string, headers []string)
+
+// verdict is the outcome of the data checks for one message.  The smtpd
+// server hands messages to its Handler only after acknowledging them, so
+// verdicts are recorded by the connection when it sees DATA complete and
+// applied by verdictHandler when the message arrives.
+type verdict struct {
+	size     int    // length of the message content
+	sum      uint64 // FNV-1a hash of the message content
+	rejected bool
+	headers  []string
+}
+
+// verdicts holds pending verdicts by remote address.  They outlive the
+// connection, since the server may deliver the message after the client
+// disconnects.
+var verdicts = struct {
+	sync.Mutex
+	m map[string][]verdict
+}{m: make(map[string][]verdict)}
+
+func contentSum(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+
+	return h.Sum64()
+}
+
+// addVerdict records v for the next message from addr with body.
+func addVerdict(addr net.Addr, body []byte, v verdict) {
+	v.size, v.sum = len(body), contentSum(body)
+
+	verdicts.Lock()
+	verdicts.m[addr.String()] = append(verdicts.m[addr.String()], v)
+	verdicts.Unlock()
+}
+
+// runChecks runs checks on body, the content of txn on c, until one
+// rejects it.  It returns their verdict and the rejecting reply, if any.
+func runChecks(checks []dataCheck, c *conn, txn *transaction, body []byte) (verdict, string) {
+	var v verdict
+	for _, check := range checks {
+		reply, headers := check(c, txn, body)
+		v.headers = append(v.headers, headers...)
+		if reply != "" {
+			v.rejected = true
+
+			return v, reply
+		}
+	}
+
+	return v, ""
+}
+
+// takeVerdict removes and returns the verdict for data, a message from
+// addr as passed to the Handler, or reports that there's none.  The smtpd
+// server prepends a Received header to the content, so verdicts match
+// against the end of data.
+func takeVerdict(addr net.Addr, data []byte) (verdict, bool) {
+	verdicts.Lock()
+	defer verdicts.Unlock()
+
+	key := addr.String()
+	vs := verdicts.m[key]
+	for i, v := range vs {
+		if v.size > len(data) || contentSum(data[len(data)-v.size:]) != v.sum {
+			continue
+		}
+
+		if vs = append(vs[:i], vs[i+1:]...); len(vs) == 0 {
+			delete(verdicts.m, key)
+		} else {
+			verdicts.m[key] = vs
+		}
+
+		return v, true
+	}
+
+	return verdict{}, false
+}
+
+// verdictHandler applies each message's verdict before passing it to
+// next.  Rejected messages are passed to quarantine if it's set, and
+// otherwise dropped.
+func verdictHandler(next, quarantine smtpd.Handler) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) {
+		v, ok := takeVerdict(origin, data)
+		switch {
+		case !ok:
+		case v.rejected && quarantine != nil:
+			log.Printf("[DATA] %s quarantined rejected message from %q\n", origin, from)
+			quarantine(origin, from, to, data)
+
+			return
+		case v.rejected:
+			log.Printf("[DATA] %s dropped rejected message from %q\n", origin, from)
+
+			return
+		case len(v.headers) > 0:
+			var b bytes.Buffer
+			for _, h := range v.headers {
+				b.WriteString(h + "\r\n")
+			}
+			data = append(b.Bytes(), data...)
+		}
+
+		next(origin, from, to, data)
+	}
+}
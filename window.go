@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// acceptWindow is a daily time-of-day window, such as 09:00-17:00.  A
+// window whose end precedes its start wraps past midnight.
+type acceptWindow struct {
+	spec       string
+	start, end int // minutes after midnight
+	loc        *time.Location
+}
+
+// parseAcceptWindow parses a window of the form HH:MM-HH:MM in loc.
+func parseAcceptWindow(spec string, loc *time.Location) (*acceptWindow, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid accept window %q: want HH:MM-HH:MM", spec)
+	}
+
+	w := &acceptWindow{spec: spec, loc: loc}
+	for i, dst := range []*int{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid accept window %q: %v", spec, err)
+		}
+		*dst = t.Hour()*60 + t.Minute()
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid accept window %q: start and end are equal", spec)
+	}
+
+	return w, nil
+}
+
+// contains reports whether t falls within the window.
+func (w *acceptWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+
+	return m >= w.start || m < w.end
+}